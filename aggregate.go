@@ -5,11 +5,11 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
-
-	opendecompress "github.com/JustinAzoff/go-opendecompress"
 )
 
 var MAX_SANE_VALUE_LEN = 1000
@@ -25,18 +25,51 @@ func stripDecimal(value string) string {
 	return value[:idx]
 }
 
+//answerType works out the type of a single answer. Zeek only logs the type
+//of the question, but the answers of an A query can be a mix of CNAME
+//targets and addresses. isOwner is set when the answer is known to own
+//another answer in the same response, which makes it a CNAME.
+func answerType(qtype string, answer string, isOwner bool) string {
+	if isOwner {
+		return "CNAME"
+	}
+	if ip := net.ParseIP(answer); ip != nil {
+		if strings.Contains(answer, ":") {
+			return "AAAA"
+		}
+		return "A"
+	}
+	switch qtype {
+	case "A", "AAAA", "A6":
+		//A name in an address response can only be an alias
+		return "CNAME"
+	}
+	return qtype
+}
+
 type DNSRecord struct {
-	ts      string
+	ts      time.Time
+	client  string
 	query   string
 	qtype   string
+	rcode   string
 	answers []string
 	ttls    []string
+	//ansQueries is the owner name of each answer, logged by
+	//dns-ans-query.bro. It is empty when the script isn't loaded.
+	ansQueries []string
 }
 
 type uniqueTuple struct {
 	query  string
 	answer string
-	qtype  string
+	qtype  string // type of the question
+	rrtype string // type of the answer
+}
+type uniqueRcode struct {
+	query string
+	qtype string
+	rcode string
 }
 type uniqueIndividual struct {
 	value string
@@ -44,13 +77,86 @@ type uniqueIndividual struct {
 }
 
 type queryStat struct {
-	count uint
-	first string
-	last  string
-	ttl   string
+	count   uint
+	first   time.Time
+	last    time.Time
+	ttl     string
+	clients *hll
+	//original is the name as it was logged, when that isn't already in
+	//the normalized form
+	original string
+}
+
+func newQueryStat(ts time.Time, ttl string) *queryStat {
+	return &queryStat{
+		first: ts,
+		last:  ts,
+		ttl:   ttl,
+		count: 1,
+	}
+}
+
+//seen records another occurrence at ts. Logs are not strictly ordered, so
+//first and last are compared instead of assuming ts is the newest.
+func (s *queryStat) seen(ts time.Time) {
+	s.count++
+	if ts.Before(s.first) {
+		s.first = ts
+	}
+	if ts.After(s.last) {
+		s.last = ts
+	}
+}
+
+func (s *queryStat) addClient(client string) {
+	if client == "" {
+		return
+	}
+	if s.clients == nil {
+		s.clients = newHLL()
+	}
+	s.clients.add(client)
+}
+
+//setOriginal remembers the first spelling of a name that had to be
+//normalized
+func (s *queryStat) setOriginal(name string, normalized string) {
+	if s.original == "" && name != normalized {
+		s.original = name
+	}
+}
+
+func (s *queryStat) merge(other *queryStat) {
+	s.count += other.count
+	if s.original == "" {
+		s.original = other.original
+	}
+	if other.first.Before(s.first) {
+		s.first = other.first
+	}
+	if other.last.After(s.last) {
+		s.last = other.last
+	}
+	s.ttl = other.ttl
+	if other.clients != nil {
+		if s.clients == nil {
+			s.clients = newHLL()
+		}
+		s.clients.merge(other.clients)
+	}
+}
+
+//clientCount is the estimated number of distinct clients
+func (s *queryStat) clientCount() uint64 {
+	if s.clients == nil {
+		return 0
+	}
+	return s.clients.estimate()
 }
 
 type aggregationResult struct {
+	//Sensor is the name of the sensor the logs came from, if any
+	Sensor         string
 	Duration       time.Duration
 	TotalRecords   uint
 	SkippedRecords uint
@@ -58,6 +164,8 @@ type aggregationResult struct {
 	TuplesLen      int
 	Individual     []aggregatedIndividual
 	IndividualLen  int
+	Rcodes         []aggregatedRcode
+	RcodesLen      int
 }
 
 type aggregatedTuple struct {
@@ -68,21 +176,31 @@ type aggregatedIndividual struct {
 	uniqueIndividual
 	queryStat
 }
+type aggregatedRcode struct {
+	uniqueRcode
+	queryStat
+}
 
 type DNSAggregator struct {
 	queries        map[uniqueTuple]*queryStat
 	values         map[uniqueIndividual]*queryStat
+	rcodes         map[uniqueRcode]*queryStat
 	totalRecords   uint
 	skippedRecords uint
-	start          time.Time
+	//ansQueryFallbacks counts records whose ans_query didn't line up with
+	//their answers, so the answers were filed under the query instead
+	ansQueryFallbacks uint
+	start             time.Time
 }
 
 func NewDNSAggregator() *DNSAggregator {
 	queries := make(map[uniqueTuple]*queryStat)
 	values := make(map[uniqueIndividual]*queryStat)
+	rcodes := make(map[uniqueRcode]*queryStat)
 	return &DNSAggregator{
 		queries: queries,
 		values:  values,
+		rcodes:  rcodes,
 		start:   time.Now(),
 	}
 }
@@ -103,19 +221,43 @@ func (d *DNSAggregator) AddRecord(r DNSRecord) {
 		return
 	}
 	d.totalRecords++
+	original := r.query
+	r.query = normalizeName(r.query)
 	query_value := uniqueIndividual{value: r.query, which: "Q"}
 
 	arec := d.values[query_value]
 	if arec == nil {
-		arec = &queryStat{
-			first: r.ts,
-			last:  r.ts,
-			count: 1,
-		}
+		arec = newQueryStat(r.ts, "")
 		d.values[query_value] = arec
 	} else {
-		arec.count++
-		arec.last = r.ts
+		arec.seen(r.ts)
+	}
+	arec.addClient(r.client)
+	arec.setOriginal(original, r.query)
+
+	//The rcode is unset when the query never got a response
+	if r.rcode != "" {
+		rcode_value := uniqueRcode{query: r.query, qtype: r.qtype, rcode: r.rcode}
+		rrec := d.rcodes[rcode_value]
+		if rrec == nil {
+			d.rcodes[rcode_value] = newQueryStat(r.ts, "")
+		} else {
+			rrec.seen(r.ts)
+		}
+	}
+
+	//With the owner of each answer the CNAME chain can be rebuilt, so a
+	//final A record is filed under the name it actually belongs to. Older
+	//versions of dns-ans-query.bro logged the query of every reply instead,
+	//those don't line up with the answers and are filed under the query.
+	var owners map[string]bool
+	if len(r.ansQueries) > 0 && len(r.ansQueries) == len(r.answers) {
+		owners = make(map[string]bool)
+		for _, owner := range r.ansQueries {
+			owners[normalizeName(owner)] = true
+		}
+	} else if len(r.ansQueries) > 0 && len(r.answers) > 0 {
+		d.ansQueryFallbacks++
 	}
 
 	for idx, answer := range r.answers {
@@ -127,7 +269,10 @@ func (d *DNSAggregator) AddRecord(r DNSRecord) {
 		if answer == "-" {
 			continue
 		}
-		ttl := stripDecimal(r.ttls[idx])
+		ttl := "0"
+		if idx < len(r.ttls) {
+			ttl = stripDecimal(r.ttls[idx])
+		}
 		//Validate that a ttl fits in a 32bit int
 		_, err := strconv.ParseInt(ttl, 10, 32)
 		if err != nil {
@@ -138,41 +283,78 @@ func (d *DNSAggregator) AddRecord(r DNSRecord) {
 		if len(ttl) > 0 && ttl[0] == '-' {
 			ttl = "0"
 		}
+		rrtype := answerType(r.qtype, answer, owners[normalizeName(answer)])
+		if isNameType(rrtype) {
+			answer = normalizeName(answer)
+		}
 		uquery := uniqueTuple{
 			query:  r.query,
 			answer: answer,
 			qtype:  r.qtype,
+			rrtype: rrtype,
+		}
+		tupleOriginal := original
+		if owners != nil {
+			tupleOriginal = r.ansQueries[idx]
+			uquery.query = normalizeName(tupleOriginal)
 		}
 		rec := d.queries[uquery]
 		if rec == nil {
-			rec = &queryStat{
-				first: r.ts,
-				last:  r.ts,
-				ttl:   ttl,
-				count: 1,
-			}
+			rec = newQueryStat(r.ts, ttl)
 			d.queries[uquery] = rec
 		} else {
-			rec.count++
-			rec.last = r.ts
+			rec.seen(r.ts)
 			rec.ttl = ttl
 		}
+		rec.addClient(r.client)
+		rec.setOriginal(tupleOriginal, uquery.query)
 
 		answer_value := uniqueIndividual{value: answer, which: "A"}
 		arec := d.values[answer_value]
 		if arec == nil {
-			arec = &queryStat{
-				first: r.ts,
-				last:  r.ts,
-				ttl:   ttl,
-				count: 1,
-			}
+			arec = newQueryStat(r.ts, ttl)
 			d.values[answer_value] = arec
 		} else {
-			arec.count++
-			arec.last = r.ts
+			arec.seen(r.ts)
 			arec.ttl = ttl
 		}
+		arec.addClient(r.client)
+	}
+}
+
+//copy returns a copy of s that doesn't share its clients sketch
+func (s queryStat) copy() *queryStat {
+	if s.clients != nil {
+		clients := newHLL()
+		clients.merge(s.clients)
+		s.clients = clients
+	}
+	return &s
+}
+
+//addTuple adds a tuple that was aggregated elsewhere, like one from a pDNS
+//export, along with its own count and first and last times
+func (d *DNSAggregator) addTuple(t uniqueTuple, stat queryStat) {
+	if rec := d.queries[t]; rec != nil {
+		rec.merge(&stat)
+	} else {
+		d.queries[t] = stat.copy()
+	}
+}
+
+func (d *DNSAggregator) addIndividual(v uniqueIndividual, stat queryStat) {
+	if rec := d.values[v]; rec != nil {
+		rec.merge(&stat)
+	} else {
+		d.values[v] = stat.copy()
+	}
+}
+
+func (d *DNSAggregator) addRcode(r uniqueRcode, stat queryStat) {
+	if rec := d.rcodes[r]; rec != nil {
+		rec.merge(&stat)
+	} else {
+		d.rcodes[r] = stat.copy()
 	}
 }
 
@@ -192,65 +374,30 @@ func (d *DNSAggregator) GetResult() aggregationResult {
 		}
 		result.Individual = append(result.Individual, agg)
 	}
+	for rcode, stat := range d.rcodes {
+		agg := aggregatedRcode{
+			uniqueRcode: rcode,
+			queryStat:   *stat,
+		}
+		result.Rcodes = append(result.Rcodes, agg)
+	}
 	result.TotalRecords = d.totalRecords
 	result.SkippedRecords = d.skippedRecords
 	result.Duration = time.Since(d.start)
 	result.TuplesLen = len(result.Tuples)
 	result.IndividualLen = len(result.Individual)
+	result.RcodesLen = len(result.Rcodes)
 	return result
 
 }
 
-//timeCompare compares timestamps, doesn't care about subsecond
-func timeCompare(a, b string) int {
-	a = stripDecimal(a)
-	b = stripDecimal(b)
-
-	if strings.Contains(a, "-") {
-		//Formatted timestamps are the same length, and can just be
-		//Compared as is
-		if a < b {
-			return -1
-		} else if a > b {
-			return 1
-		} else {
-			return 0
-		}
-	} else {
-		ai, err := strconv.ParseInt(a, 10, 64)
-		if err != nil {
-			log.Printf("Invalid timestamp: %v", a)
-			return 0
-		}
-		bi, err := strconv.ParseInt(b, 10, 64)
-		if err != nil {
-			log.Printf("Invalid timestamp: %v", b)
-			return 0
-		}
-		if ai < bi {
-			return -1
-		} else if ai > bi {
-			return 1
-		} else {
-			return 0
-		}
-	}
-}
-
 func (d *DNSAggregator) Merge(other *DNSAggregator) {
 	for q, stat := range other.queries {
 		rec := d.queries[q]
 		if rec == nil {
 			d.queries[q] = stat
 		} else {
-			rec.count += stat.count
-			if timeCompare(stat.first, rec.first) < 0 {
-				rec.first = stat.first
-			}
-			if timeCompare(stat.last, rec.last) > 0 {
-				rec.last = stat.last
-			}
-			rec.ttl = stat.ttl
+			rec.merge(stat)
 		}
 	}
 	for q, stat := range other.values {
@@ -258,34 +405,54 @@ func (d *DNSAggregator) Merge(other *DNSAggregator) {
 		if rec == nil {
 			d.values[q] = stat
 		} else {
-			rec.count += stat.count
-			if timeCompare(stat.first, rec.first) < 0 {
-				rec.first = stat.first
-			}
-			if timeCompare(stat.last, rec.last) > 0 {
-				rec.last = stat.last
-			}
-			rec.ttl = stat.ttl
+			rec.merge(stat)
+		}
+	}
+	for q, stat := range other.rcodes {
+		rec := d.rcodes[q]
+		if rec == nil {
+			d.rcodes[q] = stat
+		} else {
+			rec.merge(stat)
 		}
 	}
 	return
 }
 
 func aggregate(aggregator *DNSAggregator, fn string) error {
-	f, err := opendecompress.Open(fn)
+	f, err := os.Open(fn)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	br, err := NewBroReader(f)
+	return aggregateReader(aggregator, f, fn)
+}
+
+//aggregateReader aggregates a log from any reader, like stdin. Compression
+//is detected from the data itself since there is no file extension to go
+//by. name is only used for log messages.
+func aggregateReader(aggregator *DNSAggregator, r io.Reader, name string) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	br, err := NewBroReader(dr)
 	if err != nil {
 		return err
 	}
 
+	fallbacks := aggregator.ansQueryFallbacks
+	defer func() {
+		if n := aggregator.ansQueryFallbacks - fallbacks; n > 0 {
+			log.Printf("%s: %d records had an ans_query that doesn't match their answers, their answers were filed under the query", name, n)
+		}
+	}()
+
 	for {
 		rec, err := br.Next()
 		if errors.Is(err, io.ErrUnexpectedEOF) {
-			log.Printf("Possible truncated file %s: %v", fn, err)
+			log.Printf("Possible truncated file %s: %v", name, err)
 			break
 		}
 		if err != nil {
@@ -294,51 +461,83 @@ func aggregate(aggregator *DNSAggregator, fn string) error {
 		if rec == nil {
 			break
 		}
-		ts := rec.GetTimestamp("ts")
-		query := rec.GetString("query")
-		qtype_name := rec.GetString("qtype_name")
-		answers := rec.GetStringList("answers")
-		ttls := rec.GetStringList("TTLs")
-		if rec.Error() != nil {
-			if rec.IsMissingFieldError() {
-				log.Printf("Skipping record with missing fields: %s", rec)
-				aggregator.SkipRecord()
-				continue
-			} else {
-				return rec.Error()
-			}
-		}
-		dns_record := DNSRecord{
-			ts:      ts,
-			query:   query,
-			qtype:   qtype_name,
-			answers: answers,
-			ttls:    ttls,
+		err = aggregateRecord(aggregator, rec)
+		if err != nil {
+			return err
 		}
-		aggregator.AddRecord(dns_record)
 	}
 
 	return nil
 }
 
+//aggregateRecord adds a single log record to aggregator. Records that are
+//missing fields or have a bad timestamp are counted as skipped, any other
+//error is returned.
+func aggregateRecord(aggregator *DNSAggregator, rec Record) error {
+	ts := rec.GetTimestamp("ts")
+	query := rec.GetString("query")
+	client, _ := rec.LookupString("id.orig_h")
+	qtype_name := rec.GetString("qtype_name")
+	rcode_name, _ := rec.LookupString("rcode_name")
+	answers := rec.GetStringList("answers")
+	ttls := rec.GetStringList("TTLs")
+	var ansQueries []string
+	if rec.HasField("ans_query") {
+		ansQueries = rec.GetStringList("ans_query")
+	}
+	if rec.Error() != nil {
+		if rec.IsMissingFieldError() {
+			log.Printf("Skipping record with missing fields: %s", rec)
+			aggregator.SkipRecord()
+			return nil
+		} else if errors.Is(rec.Error(), errInvalidTimestamp) {
+			log.Printf("Skipping record with invalid timestamp: %s", rec.Error())
+			aggregator.SkipRecord()
+			return nil
+		} else {
+			return rec.Error()
+		}
+	}
+	dns_record := DNSRecord{
+		ts:         ts,
+		client:     client,
+		query:      query,
+		qtype:      qtype_name,
+		rcode:      rcode_name,
+		answers:    answers,
+		ttls:       ttls,
+		ansQueries: ansQueries,
+	}
+	aggregator.AddRecord(dns_record)
+	return nil
+}
+
 func (ar *aggregationResult) ShallowCopy() aggregationResult {
 	return aggregationResult{
+		Sensor:         ar.Sensor,
 		Duration:       ar.Duration,
 		TotalRecords:   ar.TotalRecords,
 		SkippedRecords: ar.SkippedRecords,
 		TuplesLen:      ar.TuplesLen,
 		IndividualLen:  ar.IndividualLen,
+		RcodesLen:      ar.RcodesLen,
 	}
 }
 
 type JSONTuple struct {
-	Query  string `json:"query"`
-	Type   string `json:"type"`
-	Answer string `json:"answer"`
-	TTL    string `json:"ttl"`
-	Count  uint   `json:"count"`
-	First  string `json:"first"`
-	Last   string `json:"last"`
+	Query    string    `json:"query"`
+	Original string    `json:"original,omitempty"`
+	Type     string    `json:"type"`
+	RRType   string    `json:"rrtype"`
+	Answer   string    `json:"answer"`
+	TTL      string    `json:"ttl"`
+	Count    uint      `json:"count"`
+	Clients  uint64    `json:"clients"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	//ClientsHLL is the sketch clients is estimated from, so counts can
+	//still be merged after the tuple is loaded somewhere else
+	ClientsHLL []byte `json:"clients_hll,omitempty"`
 }
 
 func (ar *aggregationResult) TupleJSONReader(reverseQuery bool) io.ReadCloser {
@@ -355,13 +554,19 @@ func (ar *aggregationResult) TupleJSONReader(reverseQuery bool) io.ReadCloser {
 				q = t.query
 			}
 			v := JSONTuple{
-				Query:  q,
-				Type:   t.qtype,
-				Answer: t.answer,
-				TTL:    t.ttl,
-				Count:  t.count,
-				First:  t.first,
-				Last:   t.last,
+				Query:    q,
+				Original: t.original,
+				Type:     t.qtype,
+				RRType:   t.rrtype,
+				Answer:   t.answer,
+				TTL:      t.ttl,
+				Count:    t.count,
+				Clients:  t.clientCount(),
+				First:    t.first,
+				Last:     t.last,
+			}
+			if t.clients != nil {
+				v.ClientsHLL = t.clients.bytes()
 			}
 			err := encoder.Encode(v)
 			if err != nil {
@@ -374,11 +579,15 @@ func (ar *aggregationResult) TupleJSONReader(reverseQuery bool) io.ReadCloser {
 }
 
 type JSONIndividual struct {
-	Value string `json:"value"`
-	Which string `json:"which"`
-	Count uint   `json:"count"`
-	First string `json:"first"`
-	Last  string `json:"last"`
+	Value    string    `json:"value"`
+	Original string    `json:"original,omitempty"`
+	Which    string    `json:"which"`
+	Count    uint      `json:"count"`
+	Clients  uint64    `json:"clients"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	//ClientsHLL is the same as in JSONTuple
+	ClientsHLL []byte `json:"clients_hll,omitempty"`
 }
 
 func (ar *aggregationResult) IndividualJSONReader(reverseQuery bool) io.ReadCloser {
@@ -395,11 +604,56 @@ func (ar *aggregationResult) IndividualJSONReader(reverseQuery bool) io.ReadClos
 				q = t.value
 			}
 			v := JSONIndividual{
-				Value: q,
-				Which: t.which,
-				Count: t.count,
-				First: t.first,
-				Last:  t.last,
+				Value:    q,
+				Original: t.original,
+				Which:    t.which,
+				Count:    t.count,
+				Clients:  t.clientCount(),
+				First:    t.first,
+				Last:     t.last,
+			}
+			if t.clients != nil {
+				v.ClientsHLL = t.clients.bytes()
+			}
+			err := encoder.Encode(v)
+			if err != nil {
+				pr.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+type JSONRcode struct {
+	Query string    `json:"query"`
+	Type  string    `json:"type"`
+	Rcode string    `json:"rcode"`
+	Count uint      `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+func (ar *aggregationResult) RcodeJSONReader(reverseQuery bool) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	encoder := json.NewEncoder(pw)
+	go func() {
+		defer pw.Close()
+		var q string
+		for _, r := range ar.Rcodes {
+			if reverseQuery {
+				q = Reverse(r.query)
+			} else {
+				q = r.query
+			}
+			v := JSONRcode{
+				Query: q,
+				Type:  r.qtype,
+				Rcode: r.rcode,
+				Count: r.count,
+				First: r.first,
+				Last:  r.last,
 			}
 			err := encoder.Encode(v)
 			if err != nil {
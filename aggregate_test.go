@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"sort"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type ByValue []aggregatedIndividual
@@ -20,18 +25,28 @@ func (a ByTuple) Len() int           { return len(a) }
 func (a ByTuple) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByTuple) Less(i, j int) bool { return a[i].query+a[i].answer < a[j].query+a[j].answer }
 
+func printTuple(r aggregatedTuple) {
+	fmt.Printf("%s %s %s %s count=%d first=%d last=%d ttl=%s\n",
+		r.query, r.qtype, r.rrtype, r.answer, r.count, r.first.Unix(), r.last.Unix(), r.ttl)
+}
+
+func printIndividual(r aggregatedIndividual) {
+	fmt.Printf("%s %s count=%d first=%d last=%d ttl=%s\n",
+		r.which, r.value, r.count, r.first.Unix(), r.last.Unix(), r.ttl)
+}
+
 func ExampleAggregate() {
 	ag := NewDNSAggregator()
 
 	ag.AddRecord(DNSRecord{
-		ts:      "10",
+		ts:      time.Unix(10, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
 		ttls:    []string{"300"},
 	})
 	ag.AddRecord(DNSRecord{
-		ts:      "20",
+		ts:      time.Unix(20, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
@@ -44,33 +59,33 @@ func ExampleAggregate() {
 
 	fmt.Printf("Tuples:\n")
 	for _, r := range res.Tuples {
-		fmt.Printf("%#v\n", r)
+		printTuple(r)
 	}
 	fmt.Printf("\nIndividual:\n")
 	for _, r := range res.Individual {
-		fmt.Printf("%#v\n", r)
+		printIndividual(r)
 	}
 	// Output:
 	//Tuples:
-	//main.aggregatedTuple{uniqueTuple:main.uniqueTuple{query:"www.example.com", answer:"1.2.3.4", qtype:"A"}, queryStat:main.queryStat{count:0x2, first:"10", last:"20", ttl:"300"}}
+	//www.example.com A A 1.2.3.4 count=2 first=10 last=20 ttl=300
 	//
 	//Individual:
-	//main.aggregatedIndividual{uniqueIndividual:main.uniqueIndividual{value:"1.2.3.4", which:"A"}, queryStat:main.queryStat{count:0x2, first:"10", last:"20", ttl:"300"}}
-	//main.aggregatedIndividual{uniqueIndividual:main.uniqueIndividual{value:"www.example.com", which:"Q"}, queryStat:main.queryStat{count:0x2, first:"10", last:"20", ttl:""}}
+	//A 1.2.3.4 count=2 first=10 last=20 ttl=300
+	//Q www.example.com count=2 first=10 last=20 ttl=
 }
 
 func ExampleAggregateMerge() {
 	ag := NewDNSAggregator()
 
 	ag.AddRecord(DNSRecord{
-		ts:      "10",
+		ts:      time.Unix(10, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
 		ttls:    []string{"300"},
 	})
 	ag.AddRecord(DNSRecord{
-		ts:      "200",
+		ts:      time.Unix(200, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
@@ -78,21 +93,21 @@ func ExampleAggregateMerge() {
 	})
 	ag2 := NewDNSAggregator()
 	ag2.AddRecord(DNSRecord{
-		ts:      "30",
+		ts:      time.Unix(30, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
 		ttls:    []string{"300"},
 	})
 	ag2.AddRecord(DNSRecord{
-		ts:      "30",
+		ts:      time.Unix(30, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.5"},
 		ttls:    []string{"300"},
 	})
 	ag2.AddRecord(DNSRecord{
-		ts:      "40",
+		ts:      time.Unix(40, 0).UTC(),
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.5"},
@@ -107,21 +122,21 @@ func ExampleAggregateMerge() {
 
 	fmt.Printf("Tuples:\n")
 	for _, r := range res.Tuples {
-		fmt.Printf("%#v\n", r)
+		printTuple(r)
 	}
 	fmt.Printf("\nIndividual:\n")
 	for _, r := range res.Individual {
-		fmt.Printf("%#v\n", r)
+		printIndividual(r)
 	}
 	// Output:
 	//Tuples:
-	//main.aggregatedTuple{uniqueTuple:main.uniqueTuple{query:"www.example.com", answer:"1.2.3.4", qtype:"A"}, queryStat:main.queryStat{count:0x3, first:"10", last:"200", ttl:"300"}}
-	//main.aggregatedTuple{uniqueTuple:main.uniqueTuple{query:"www.example.com", answer:"1.2.3.5", qtype:"A"}, queryStat:main.queryStat{count:0x2, first:"30", last:"40", ttl:"300"}}
+	//www.example.com A A 1.2.3.4 count=3 first=10 last=200 ttl=300
+	//www.example.com A A 1.2.3.5 count=2 first=30 last=40 ttl=300
 	//
 	//Individual:
-	//main.aggregatedIndividual{uniqueIndividual:main.uniqueIndividual{value:"1.2.3.4", which:"A"}, queryStat:main.queryStat{count:0x3, first:"10", last:"200", ttl:"300"}}
-	//main.aggregatedIndividual{uniqueIndividual:main.uniqueIndividual{value:"1.2.3.5", which:"A"}, queryStat:main.queryStat{count:0x2, first:"30", last:"40", ttl:"300"}}
-	//main.aggregatedIndividual{uniqueIndividual:main.uniqueIndividual{value:"www.example.com", which:"Q"}, queryStat:main.queryStat{count:0x5, first:"10", last:"200", ttl:""}}
+	//A 1.2.3.4 count=3 first=10 last=200 ttl=300
+	//A 1.2.3.5 count=2 first=30 last=40 ttl=300
+	//Q www.example.com count=5 first=10 last=200 ttl=
 
 }
 
@@ -142,14 +157,16 @@ func ExampleResultTupleJSONReader() {
 	ag := NewDNSAggregator()
 
 	ag.AddRecord(DNSRecord{
-		ts:      "10",
+		ts:      time.Unix(10, 0).UTC(),
+		client:  "192.168.1.1",
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
 		ttls:    []string{"300"},
 	})
 	ag.AddRecord(DNSRecord{
-		ts:      "20",
+		ts:      time.Unix(20, 0).UTC(),
+		client:  "192.168.1.2",
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.5"},
@@ -166,22 +183,24 @@ func ExampleResultTupleJSONReader() {
 	}
 	fmt.Printf("%s", body)
 	// Output:
-	//{"query":"www.example.com","type":"A","answer":"1.2.3.4","ttl":"300","count":1,"first":"10","last":"10"}
-	//{"query":"www.example.com","type":"A","answer":"1.2.3.5","ttl":"300","count":1,"first":"20","last":"20"}
+	//{"query":"www.example.com","type":"A","rrtype":"A","answer":"1.2.3.4","ttl":"300","count":1,"clients":1,"first":"1970-01-01T00:00:10Z","last":"1970-01-01T00:00:10Z","clients_hll":"BsIB"}
+	//{"query":"www.example.com","type":"A","rrtype":"A","answer":"1.2.3.5","ttl":"300","count":1,"clients":1,"first":"1970-01-01T00:00:20Z","last":"1970-01-01T00:00:20Z","clients_hll":"CRgB"}
 }
 
 func ExampleResultIndividualJSONReader() {
 	ag := NewDNSAggregator()
 
 	ag.AddRecord(DNSRecord{
-		ts:      "10",
+		ts:      time.Unix(10, 0).UTC(),
+		client:  "192.168.1.1",
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.4"},
 		ttls:    []string{"300"},
 	})
 	ag.AddRecord(DNSRecord{
-		ts:      "20",
+		ts:      time.Unix(20, 0).UTC(),
+		client:  "192.168.1.2",
 		query:   "www.example.com",
 		qtype:   "A",
 		answers: []string{"1.2.3.5"},
@@ -198,7 +217,205 @@ func ExampleResultIndividualJSONReader() {
 	}
 	fmt.Printf("%s", body)
 	// Output:
-	//{"value":"1.2.3.4","which":"A","count":1,"first":"10","last":"10"}
-	//{"value":"1.2.3.5","which":"A","count":1,"first":"20","last":"20"}
-	//{"value":"www.example.com","which":"Q","count":2,"first":"10","last":"20"}
+	//{"value":"1.2.3.4","which":"A","count":1,"clients":1,"first":"1970-01-01T00:00:10Z","last":"1970-01-01T00:00:10Z","clients_hll":"BsIB"}
+	//{"value":"1.2.3.5","which":"A","count":1,"clients":1,"first":"1970-01-01T00:00:20Z","last":"1970-01-01T00:00:20Z","clients_hll":"CRgB"}
+	//{"value":"www.example.com","which":"Q","count":2,"clients":2,"first":"1970-01-01T00:00:10Z","last":"1970-01-01T00:00:20Z","clients_hll":"BsIBCRgB"}
+}
+
+func TestAggregateReader(t *testing.T) {
+	fn := "test_data/reddit_dns_2016-04-01.log"
+	expected := NewDNSAggregator()
+	if err := aggregate(expected, fn); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(plain)
+	zw.Close()
+
+	for name, data := range map[string][]byte{"plain": plain, "gzip": compressed.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			ag := NewDNSAggregator()
+			err := aggregateReader(ag, bytes.NewReader(data), "-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := ag.GetResult()
+			exp := expected.GetResult()
+			sort.Sort(ByTuple(res.Tuples))
+			sort.Sort(ByTuple(exp.Tuples))
+			assert.Equal(t, exp.TotalRecords, res.TotalRecords)
+			assert.Equal(t, exp.Tuples, res.Tuples)
+		})
+	}
+}
+
+func Example_aggregateCNAMEChain() {
+	ag := NewDNSAggregator()
+
+	ag.AddRecord(DNSRecord{
+		ts:         time.Unix(10, 0).UTC(),
+		query:      "www.example.com",
+		qtype:      "A",
+		answers:    []string{"www.example.com.cdn.net", "edge.cdn.net", "1.2.3.4"},
+		ttls:       []string{"300", "60", "20"},
+		ansQueries: []string{"www.example.com", "www.example.com.cdn.net", "edge.cdn.net"},
+	})
+	//Without ans_query everything is filed under the query
+	ag.AddRecord(DNSRecord{
+		ts:      time.Unix(20, 0).UTC(),
+		query:   "www.example.org",
+		qtype:   "A",
+		answers: []string{"edge.cdn.net", "1.2.3.4"},
+		ttls:    []string{"60", "20"},
+	})
+
+	res := ag.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+	for _, r := range res.Tuples {
+		printTuple(r)
+	}
+	// Output:
+	//edge.cdn.net A A 1.2.3.4 count=1 first=10 last=10 ttl=20
+	//www.example.com.cdn.net A CNAME edge.cdn.net count=1 first=10 last=10 ttl=60
+	//www.example.com A CNAME www.example.com.cdn.net count=1 first=10 last=10 ttl=300
+	//www.example.org A A 1.2.3.4 count=1 first=20 last=20 ttl=20
+	//www.example.org A CNAME edge.cdn.net count=1 first=20 last=20 ttl=60
+}
+
+func TestAggregateAnsQuery(t *testing.T) {
+	ag := NewDNSAggregator()
+	err := aggregate(ag, "test_data/ans_query.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ag.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+	var tuples []uniqueTuple
+	for _, r := range res.Tuples {
+		tuples = append(tuples, r.uniqueTuple)
+	}
+	assert.Equal(t, []uniqueTuple{
+		{query: "reddit.map.fastly.net", answer: "151.101.1.140", qtype: "A", rrtype: "A"},
+		{query: "reddit.map.fastly.net", answer: "151.101.65.140", qtype: "A", rrtype: "A"},
+		{query: "www.reddit.com", answer: "reddit.map.fastly.net", qtype: "A", rrtype: "CNAME"},
+	}, tuples)
+	assert.EqualValues(t, 2, res.Tuples[0].count)
+	assert.EqualValues(t, 0, ag.ansQueryFallbacks)
+}
+
+//ans_query_reply.log is laid out the way older versions of
+//dns-ans-query.bro logged, with the query of every reply instead of the
+//owner of every answer
+func TestAggregateAnsQueryReply(t *testing.T) {
+	ag := NewDNSAggregator()
+	err := aggregate(ag, "test_data/ans_query_reply.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := ag.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+	var tuples []uniqueTuple
+	for _, r := range res.Tuples {
+		tuples = append(tuples, r.uniqueTuple)
+	}
+	//The chain can't be rebuilt, so its answers stay with the query
+	assert.Equal(t, []uniqueTuple{
+		{query: "reddit.map.fastly.net", answer: "151.101.1.140", qtype: "A", rrtype: "A"},
+		{query: "www.reddit.com", answer: "151.101.1.140", qtype: "A", rrtype: "A"},
+		{query: "www.reddit.com", answer: "151.101.65.140", qtype: "A", rrtype: "A"},
+		{query: "www.reddit.com", answer: "reddit.map.fastly.net", qtype: "A", rrtype: "CNAME"},
+	}, tuples)
+	assert.EqualValues(t, 4, res.TotalRecords)
+	assert.EqualValues(t, 0, res.SkippedRecords)
+	assert.EqualValues(t, 1, ag.ansQueryFallbacks)
+}
+
+func TestAnswerType(t *testing.T) {
+	tests := []struct {
+		qtype   string
+		answer  string
+		isOwner bool
+		want    string
+	}{
+		{"A", "1.2.3.4", false, "A"},
+		{"A", "2001:db8::1", false, "AAAA"},
+		{"AAAA", "2001:db8::1", false, "AAAA"},
+		{"AAAA", "::ffff:1.2.3.4", false, "AAAA"},
+		{"A", "reddit.map.fastly.net", false, "CNAME"},
+		{"AAAA", "reddit.map.fastly.net", false, "CNAME"},
+		{"MX", "alias.example.com", true, "CNAME"},
+		{"MX", "mx1.example.com", false, "MX"},
+		{"PTR", "www.example.com", false, "PTR"},
+		{"ANY", "1.2.3.4", false, "A"},
+		{"TXT", "TXT 10 v=spf1 -all", false, "TXT"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, answerType(tt.qtype, tt.answer, tt.isOwner), "%s %s", tt.qtype, tt.answer)
+	}
+}
+
+func Example_aggregateNormalize() {
+	ag := NewDNSAggregator()
+	for i, query := range []string{"www.bücher.example", "WWW.Bücher.Example.", "www.xn--bcher-kva.example"} {
+		ag.AddRecord(DNSRecord{
+			ts:      time.Unix(int64(10*(i+1)), 0).UTC(),
+			query:   query,
+			qtype:   "MX",
+			answers: []string{"MX1.Example.COM."},
+			ttls:    []string{"300"},
+		})
+	}
+	ag.AddRecord(DNSRecord{
+		ts:      time.Unix(40, 0).UTC(),
+		query:   "WWW.BÜCHER.EXAMPLE",
+		qtype:   "TXT",
+		answers: []string{"TXT v=spf1 -all"},
+		ttls:    []string{"300"},
+	})
+
+	res := ag.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+	for _, r := range res.Tuples {
+		printTuple(r)
+	}
+	sort.Sort(ByValue(res.Individual))
+	for _, r := range res.Individual {
+		printIndividual(r)
+	}
+	// Output:
+	//www.xn--bcher-kva.example TXT TXT TXT v=spf1 -all count=1 first=40 last=40 ttl=300
+	//www.xn--bcher-kva.example MX MX mx1.example.com count=3 first=10 last=30 ttl=300
+	//A TXT v=spf1 -all count=1 first=40 last=40 ttl=300
+	//A mx1.example.com count=3 first=10 last=30 ttl=300
+	//Q www.xn--bcher-kva.example count=4 first=10 last=40 ttl=
+}
+
+func TestAggregateOriginal(t *testing.T) {
+	ag := NewDNSAggregator()
+	for _, query := range []string{"www.example.com", "WWW.Example.com", "www.EXAMPLE.com"} {
+		ag.AddRecord(DNSRecord{
+			ts:      time.Unix(10, 0).UTC(),
+			query:   query,
+			qtype:   "A",
+			answers: []string{"1.2.3.4"},
+			ttls:    []string{"300"},
+		})
+	}
+	res := ag.GetResult()
+	if assert.Len(t, res.Tuples, 1) {
+		assert.Equal(t, "www.example.com", res.Tuples[0].query)
+		assert.EqualValues(t, 3, res.Tuples[0].count)
+		//Only the first spelling that differed is kept
+		assert.Equal(t, "WWW.Example.com", res.Tuples[0].original)
+	}
+	body, err := ioutil.ReadAll(res.TupleJSONReader(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(body), `"query":"www.example.com","original":"WWW.Example.com"`)
 }
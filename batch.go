@@ -0,0 +1,275 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+//batchFormat is in the header of every batch so anything else is rejected
+//instead of being loaded as an empty batch
+const batchFormat = "zeek-pdns-aggregate"
+const batchVersion = 1
+
+//batchHeader is the first line of a batch of aggregated logs. The rest of
+//the batch is the tuples, individual values and rcodes in the format
+//TupleJSONReader, IndividualJSONReader and RcodeJSONReader write, one per
+//line.
+type batchHeader struct {
+	Format  string      `json:"format"`
+	Version int         `json:"version"`
+	Sensor  string      `json:"sensor,omitempty"`
+	Files   []batchFile `json:"files"`
+}
+
+//batchFile is what aggregating one of the logs in a batch found, which is
+//recorded with SetLogIndexed when the batch is loaded. Logs read from
+//stdin without a name have no name and aren't recorded.
+type batchFile struct {
+	Name           string  `json:"name"`
+	Duration       float64 `json:"duration"`
+	TotalRecords   uint    `json:"total_records"`
+	SkippedRecords uint    `json:"skipped_records"`
+	Tuples         int     `json:"tuples"`
+	Individual     int     `json:"individual"`
+	Rcodes         int     `json:"rcodes"`
+}
+
+func newBatchFile(name string, ar aggregationResult) batchFile {
+	return batchFile{
+		Name:           name,
+		Duration:       ar.Duration.Seconds(),
+		TotalRecords:   ar.TotalRecords,
+		SkippedRecords: ar.SkippedRecords,
+		Tuples:         ar.TuplesLen,
+		Individual:     ar.IndividualLen,
+		Rcodes:         ar.RcodesLen,
+	}
+}
+
+func (bf batchFile) result() aggregationResult {
+	return aggregationResult{
+		Duration:       time.Duration(bf.Duration * float64(time.Second)),
+		TotalRecords:   bf.TotalRecords,
+		SkippedRecords: bf.SkippedRecords,
+		TuplesLen:      bf.Tuples,
+		IndividualLen:  bf.Individual,
+		RcodesLen:      bf.Rcodes,
+	}
+}
+
+//aggregateBatch aggregates logs from sensor into a single batch
+func aggregateBatch(sensor string, sources []logSource) (batchHeader, aggregationResult, error) {
+	hdr := batchHeader{Format: batchFormat, Version: batchVersion, Sensor: sensor, Files: []batchFile{}}
+	aggregator := NewDNSAggregator()
+	for _, src := range sources {
+		fileAgg := NewDNSAggregator()
+		err := src.aggregate(fileAgg)
+		if err != nil {
+			return hdr, aggregationResult{}, fmt.Errorf("Error Aggregating %s: %w", src, err)
+		}
+		aggregator.Merge(fileAgg)
+		aggregated := fileAgg.GetResult()
+		log.Printf("%s: Aggregation: Duration=%0.1f TotalRecords=%d SkippedRecords=%d Tuples=%d Individual=%d",
+			src,
+			aggregated.Duration.Seconds(),
+			aggregated.TotalRecords,
+			aggregated.SkippedRecords,
+			aggregated.TuplesLen,
+			aggregated.IndividualLen,
+		)
+		hdr.Files = append(hdr.Files, newBatchFile(src.name, aggregated))
+	}
+	aggregated := aggregator.GetResult()
+	aggregated.Sensor = sensor
+	return hdr, aggregated, nil
+}
+
+//writeBatch writes a gzip compressed batch
+func writeBatch(w io.Writer, hdr batchHeader, ar aggregationResult) error {
+	zw := gzip.NewWriter(w)
+	err := json.NewEncoder(zw).Encode(hdr)
+	if err != nil {
+		return err
+	}
+	//The readers start writing as soon as they are created, so they are
+	//only created once the previous one is done
+	for _, reader := range []func(bool) io.ReadCloser{ar.TupleJSONReader, ar.IndividualJSONReader, ar.RcodeJSONReader} {
+		r := reader(false)
+		_, err = io.Copy(zw, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+//errBatchTooLarge is returned by readBatch for a batch that is larger than
+//its limit, either compressed or after decompressing it
+var errBatchTooLarge = errors.New("batch too large")
+
+//limitedReader is like io.LimitReader, but fails with errBatchTooLarge
+//instead of pretending the batch ended there
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, errBatchTooLarge
+	}
+	//Read one byte past the limit to tell a batch of exactly the limit
+	//from a larger one
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.n {
+		n = int(lr.n)
+		lr.n = -1
+		return n, errBatchTooLarge
+	}
+	lr.n -= int64(n)
+	return n, err
+}
+
+//readBatch reads a batch written by writeBatch. The totals are those of
+//the logs that were aggregated, not the number of lines in the batch.
+//Unless maxBytes is 0 a batch that is larger than maxBytes, compressed or
+//not, fails with errBatchTooLarge.
+func readBatch(r io.Reader, name string, maxBytes int64) (batchHeader, aggregationResult, error) {
+	var hdr batchHeader
+	if maxBytes > 0 {
+		r = &limitedReader{r: r, n: maxBytes}
+	}
+	dr, err := decompressReader(r)
+	if err != nil {
+		return hdr, aggregationResult{}, err
+	}
+	defer dr.Close()
+	var br io.Reader = dr
+	if maxBytes > 0 {
+		br = &limitedReader{r: dr, n: maxBytes}
+	}
+	dec := json.NewDecoder(br)
+	err = dec.Decode(&hdr)
+	if err != nil {
+		return hdr, aggregationResult{}, fmt.Errorf("%s: reading header: %w", name, err)
+	}
+	if hdr.Format != batchFormat {
+		return hdr, aggregationResult{}, fmt.Errorf("%s: not an aggregate batch", name)
+	}
+	if hdr.Version != batchVersion {
+		return hdr, aggregationResult{}, fmt.Errorf("%s: unsupported batch version %d", name, hdr.Version)
+	}
+
+	aggregator := NewDNSAggregator()
+	im := newImporter(aggregator)
+	im.individual = true
+	err = im.decode(dec, "ndjson", name)
+	if err != nil {
+		return hdr, aggregationResult{}, err
+	}
+	aggregated := aggregator.GetResult()
+	aggregated.Sensor = hdr.Sensor
+	aggregated.TotalRecords, aggregated.SkippedRecords, aggregated.Duration = 0, 0, 0
+	for _, f := range hdr.Files {
+		aggregated.TotalRecords += f.TotalRecords
+		aggregated.SkippedRecords += f.SkippedRecords
+		aggregated.Duration += f.result().Duration
+	}
+	return hdr, aggregated, nil
+}
+
+func ingestFile(store Store, sensor string, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ingest(store, sensor, f, fn)
+}
+
+//errPartiallyIndexed is returned for a batch with some of its logs already
+//indexed. A batch can't be split up again, so it can't be loaded without
+//counting those twice.
+var errPartiallyIndexed = errors.New("some of the logs in the batch are already indexed")
+
+//ingest loads a batch into the store. sensor overrides the sensor in the
+//batch when it is set.
+func ingest(store Store, sensor string, r io.Reader, name string) error {
+	hdr, aggregated, err := readBatch(r, name, 0)
+	if err != nil {
+		return err
+	}
+	_, err = loadBatch(store, sensor, hdr, aggregated, name)
+	return err
+}
+
+//loadBatch loads a batch that was read with readBatch unless its logs were
+//already indexed, and returns whether it did
+func loadBatch(store Store, sensor string, hdr batchHeader, aggregated aggregationResult, name string) (bool, error) {
+	if sensor == "" {
+		sensor = hdr.Sensor
+	}
+	aggregated.Sensor = sensor
+	store.Begin()
+	loaded, err := loadBatchTx(store, sensor, hdr, aggregated, name)
+	if err != nil {
+		store.Rollback()
+	}
+	return loaded, err
+}
+
+func loadBatchTx(store Store, sensor string, hdr batchHeader, aggregated aggregationResult, name string) (bool, error) {
+	var named, indexed []string
+	for _, f := range hdr.Files {
+		if f.Name == "" {
+			continue
+		}
+		named = append(named, f.Name)
+		done, err := store.IsLogIndexed(sensor, f.Name)
+		if err != nil {
+			return false, fmt.Errorf("store.IsLogIndexed: %w", err)
+		}
+		if done {
+			indexed = append(indexed, f.Name)
+		}
+	}
+	if len(indexed) > 0 && len(indexed) == len(named) {
+		log.Printf("%s: Already indexed", name)
+		return false, store.Commit()
+	}
+	if len(indexed) > 0 {
+		return false, fmt.Errorf("%s: %w: %s", name, errPartiallyIndexed, strings.Join(indexed, ", "))
+	}
+
+	result, err := store.Update(aggregated)
+	if err != nil {
+		return false, fmt.Errorf("store.Update: %w", err)
+	}
+	log.Printf("%s: Store: Duration=%0.1f Inserted=%d Updated=%d", name, result.Duration.Seconds(), result.Inserted, result.Updated)
+	var emptyStoreResult UpdateResult
+	for _, f := range hdr.Files {
+		if f.Name == "" {
+			continue
+		}
+		err = store.SetLogIndexed(sensor, f.Name, f.result(), emptyStoreResult)
+		if err != nil {
+			return false, fmt.Errorf("store.SetLogIndexed: %w", err)
+		}
+	}
+	err = store.Commit()
+	if err != nil {
+		return false, fmt.Errorf("store.Commit: %w", err)
+	}
+	return true, nil
+}
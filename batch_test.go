@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestBatch(t *testing.T, sensor string, fns ...string) []byte {
+	hdr, aggregated, err := aggregateBatch(sensor, fileSources(fns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = writeBatch(&buf, hdr, aggregated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	fn := "test_data/reddit_dns_2016-04-01.log"
+	expected := NewDNSAggregator()
+	if err := aggregate(expected, fn); err != nil {
+		t.Fatal(err)
+	}
+	exp := expected.GetResult()
+
+	hdr, res, err := readBatch(bytes.NewReader(writeTestBatch(t, "dmz", fn)), "batch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dmz", hdr.Sensor)
+	if assert.Len(t, hdr.Files, 1) {
+		assert.Equal(t, fn, hdr.Files[0].Name)
+		assert.Equal(t, exp.TuplesLen, hdr.Files[0].Tuples)
+	}
+	assert.Equal(t, exp.TotalRecords, res.TotalRecords)
+	assert.Equal(t, exp.SkippedRecords, res.SkippedRecords)
+
+	sort.Sort(ByTuple(res.Tuples))
+	sort.Sort(ByTuple(exp.Tuples))
+	if assert.Len(t, res.Tuples, len(exp.Tuples)) {
+		for i := range exp.Tuples {
+			assert.Equal(t, exp.Tuples[i].uniqueTuple, res.Tuples[i].uniqueTuple)
+			assert.Equal(t, exp.Tuples[i].count, res.Tuples[i].count)
+			assert.Equal(t, exp.Tuples[i].ttl, res.Tuples[i].ttl)
+			assert.True(t, exp.Tuples[i].first.Equal(res.Tuples[i].first))
+			assert.True(t, exp.Tuples[i].last.Equal(res.Tuples[i].last))
+			assert.Equal(t, exp.Tuples[i].clients.bytes(), res.Tuples[i].clients.bytes())
+		}
+	}
+	assert.Len(t, res.Individual, len(exp.Individual))
+	assert.Len(t, res.Rcodes, len(exp.Rcodes))
+}
+
+func TestBatchInvalid(t *testing.T) {
+	_, _, err := readBatch(strings.NewReader(`{"rrname":"example.com","rrtype":"A","rdata":"1.2.3.4"}`), "cof", 0)
+	assert.Error(t, err)
+	_, _, err = readBatch(strings.NewReader(`{"format":"zeek-pdns-aggregate","version":2}`), "v2", 0)
+	assert.Error(t, err)
+
+	//A truncated batch isn't loaded at all
+	batch := writeTestBatch(t, "", "test_data/reddit_1.txt")
+	_, _, err = readBatch(bytes.NewReader(batch[:len(batch)/2]), "truncated", 0)
+	assert.Error(t, err)
+
+	//The limit applies to the compressed batch and to what it decompresses
+	//to, which is far larger
+	_, _, err = readBatch(bytes.NewReader(batch), "compressed", int64(len(batch)-1))
+	assert.True(t, errors.Is(err, errBatchTooLarge), "err = %v", err)
+	_, _, err = readBatch(bytes.NewReader(batch), "decompressed", int64(len(batch)))
+	assert.True(t, errors.Is(err, errBatchTooLarge), "err = %v", err)
+	_, _, err = readBatch(bytes.NewReader(batch), "unlimited", 0)
+	assert.NoError(t, err)
+}
+
+func TestIngest(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			LoadFile(t, store, "test_data/reddit_1.txt")
+			want, err := store.LikeTuples("reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Clear()
+			store.Init()
+
+			batch := writeTestBatch(t, "dmz", "test_data/reddit_1.txt")
+			for i := 0; i < 2; i++ {
+				err = ingest(store, "", bytes.NewReader(batch), "batch")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			indexed, err := store.IsLogIndexed("dmz", "test_data/reddit_1.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, indexed)
+			got, err := store.LikeTuples("reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, got)
+
+			//Loading a batch that overlaps one that was already loaded
+			//would count the overlapping log twice
+			both := writeTestBatch(t, "dmz", "test_data/reddit_1.txt", "test_data/reddit_2.txt")
+			err = ingest(store, "", bytes.NewReader(both), "both")
+			assert.Error(t, err)
+		})
+	}
+}
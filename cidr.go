@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+//ipRange parses a CIDR prefix like 10.1.0.0/16 or an explicit range like
+//10.1.0.0-10.1.255.255 into the first and last address it covers. Both are
+//returned in their 16 byte form, IPv4 addresses are IPv4-mapped.
+func ipRange(prefix string) (net.IP, net.IP, error) {
+	if idx := strings.Index(prefix, "-"); idx != -1 {
+		lo := net.ParseIP(strings.TrimSpace(prefix[:idx]))
+		hi := net.ParseIP(strings.TrimSpace(prefix[idx+1:]))
+		if lo == nil || hi == nil || (lo.To4() == nil) != (hi.To4() == nil) {
+			return nil, nil, fmt.Errorf("invalid address range %q", prefix)
+		}
+		return lo.To16(), hi.To16(), nil
+	}
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	lo := network.IP.To16()
+	hi := make(net.IP, len(lo))
+	//The mask is 4 bytes for IPv4, it covers the end of the 16 byte form
+	offset := len(lo) - len(network.Mask)
+	copy(hi, lo)
+	for i, m := range network.Mask {
+		hi[offset+i] |= ^m
+	}
+	return lo, hi, nil
+}
+
+//isIPRange is true when a search is for a prefix or range instead of a
+//single value
+func isIPRange(value string) bool {
+	if !strings.ContainsAny(value, "/-") {
+		return false
+	}
+	_, _, err := ipRange(value)
+	return err == nil
+}
+
+//answerIP returns the address of an A or AAAA answer in its 16 byte form,
+//or nil for any other answer
+func answerIP(rrtype string, answer string) net.IP {
+	if rrtype != "A" && rrtype != "AAAA" {
+		return nil
+	}
+	return net.ParseIP(answer).To16()
+}
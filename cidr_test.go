@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPRange(t *testing.T) {
+	tests := []struct {
+		prefix string
+		lo     string
+		hi     string
+	}{
+		{"10.1.0.0/16", "10.1.0.0", "10.1.255.255"},
+		{"10.1.2.3/16", "10.1.0.0", "10.1.255.255"},
+		{"10.1.2.3/32", "10.1.2.3", "10.1.2.3"},
+		{"10.1.0.0-10.1.3.255", "10.1.0.0", "10.1.3.255"},
+		{"2001:db8::/32", "2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:0db8:0000::/48", "2001:db8::", "2001:db8:0:ffff:ffff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		lo, hi, err := ipRange(tt.prefix)
+		if assert.NoError(t, err, tt.prefix) {
+			assert.Equal(t, tt.lo, lo.String(), tt.prefix)
+			assert.Equal(t, tt.hi, hi.String(), tt.prefix)
+			assert.Len(t, lo, 16)
+			assert.Len(t, hi, 16)
+		}
+	}
+	for _, bad := range []string{"10.1.2.3", "www.example.com", "my-host.example.com", "10.1.0.0-2001:db8::1", "10.1.0.0/33"} {
+		assert.False(t, isIPRange(bad), bad)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+//cofRecord is a tuple in the passive DNS Common Output Format from
+//draft-dulaunoy-dnsop-passive-dns-cof. Zeek logs don't say which zone an
+//answer came from, so there is never a bailiwick.
+type cofRecord struct {
+	RRName    string `json:"rrname"`
+	RRType    string `json:"rrtype"`
+	RData     string `json:"rdata"`
+	TimeFirst int64  `json:"time_first"`
+	TimeLast  int64  `json:"time_last"`
+	Count     uint   `json:"count"`
+	Bailiwick string `json:"bailiwick,omitempty"`
+	SensorID  string `json:"sensor_id,omitempty"`
+}
+
+//cofTime converts the first and last times stores return to seconds since
+//the epoch
+func cofTime(t string) (int64, error) {
+	ts, err := parseTimestamp(t)
+	if err != nil {
+		return 0, err
+	}
+	return ts.Unix(), nil
+}
+
+func (tr tupleResult) cof() (cofRecord, error) {
+	rec := cofRecord{
+		RRName:   tr.Query,
+		RRType:   tr.RRType,
+		RData:    tr.Answer,
+		Count:    tr.Count,
+		SensorID: tr.Sensor,
+	}
+	var err error
+	rec.TimeFirst, err = cofTime(tr.First)
+	if err != nil {
+		return rec, err
+	}
+	rec.TimeLast, err = cofTime(tr.Last)
+	return rec, err
+}
+
+//cofWriter writes tuples as COF, one JSON object per line
+type cofWriter struct {
+	enc *json.Encoder
+}
+
+func newCOFWriter(w io.Writer) *cofWriter {
+	return &cofWriter{enc: json.NewEncoder(w)}
+}
+
+func (cw *cofWriter) Write(tr tupleResult) error {
+	rec, err := tr.cof()
+	if err != nil {
+		return err
+	}
+	return cw.enc.Encode(rec)
+}
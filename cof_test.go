@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Example_cofWriter() {
+	cw := newCOFWriter(os.Stdout)
+	cw.Write(tupleResult{
+		Query:  "www.example.com",
+		Type:   "A",
+		RRType: "A",
+		Answer: "1.2.3.4",
+		Count:  2,
+		First:  "2016-04-01 00:03:03.750000",
+		Last:   "2016-04-02T10:00:00Z",
+	})
+	cw.Write(tupleResult{
+		Sensor: "dmz",
+		Query:  "example.com",
+		Type:   "MX",
+		RRType: "MX",
+		Answer: "mail.example.com",
+		Count:  1,
+		First:  "2016-04-01 00:00:00",
+		Last:   "2016-04-01 00:00:00",
+	})
+	// Output:
+	// {"rrname":"www.example.com","rrtype":"A","rdata":"1.2.3.4","time_first":1459468983,"time_last":1459591200,"count":2}
+	// {"rrname":"example.com","rrtype":"MX","rdata":"mail.example.com","time_first":1459468800,"time_last":1459468800,"count":1,"sensor_id":"dmz"}
+}
+
+func TestCOFInvalidTime(t *testing.T) {
+	_, err := tupleResult{First: "yesterday", Last: "today"}.cof()
+	assert.Error(t, err)
+}
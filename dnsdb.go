@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//dnsdbDefaultLimit is the limit DNSDB uses when none is given
+const dnsdbDefaultLimit = 10000
+
+//safLine is a line of the Streaming Application Format DNSDB API v2
+//answers in. A response is a begin line, a line per result and a line
+//saying whether all of them were returned.
+type safLine struct {
+	Cond string      `json:"cond,omitempty"`
+	Msg  string      `json:"msg,omitempty"`
+	Obj  interface{} `json:"obj,omitempty"`
+}
+
+//dnsdbRRset is the result of an rrset lookup. Zeek logs don't say which
+//answers arrived together, or what the bailiwick was, so every tuple is
+//an rrset with a single answer.
+type dnsdbRRset struct {
+	Count     uint     `json:"count"`
+	TimeFirst int64    `json:"time_first"`
+	TimeLast  int64    `json:"time_last"`
+	RRName    string   `json:"rrname"`
+	RRType    string   `json:"rrtype"`
+	RData     []string `json:"rdata"`
+}
+
+//dnsdbRData is the result of an rdata lookup
+type dnsdbRData struct {
+	Count     uint   `json:"count"`
+	TimeFirst int64  `json:"time_first"`
+	TimeLast  int64  `json:"time_last"`
+	RRName    string `json:"rrname"`
+	RRType    string `json:"rrtype"`
+	RData     string `json:"rdata"`
+}
+
+//dnsdbName adds the root dot DNSDB has on every name
+func dnsdbName(name string) string {
+	if name == "" || strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func dnsdbRDataValue(tr tupleResult) string {
+	if isNameType(tr.RRType) {
+		return dnsdbName(tr.Answer)
+	}
+	return tr.Answer
+}
+
+func dnsdbTimes(tr tupleResult) (int64, int64, error) {
+	first, err := cofTime(tr.First)
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := cofTime(tr.Last)
+	return first, last, err
+}
+
+func dnsdbRRsetObj(tr tupleResult) (interface{}, error) {
+	first, last, err := dnsdbTimes(tr)
+	return dnsdbRRset{
+		Count:     tr.Count,
+		TimeFirst: first,
+		TimeLast:  last,
+		RRName:    dnsdbName(tr.Query),
+		RRType:    tr.RRType,
+		RData:     []string{dnsdbRDataValue(tr)},
+	}, err
+}
+
+func dnsdbRDataObj(tr tupleResult) (interface{}, error) {
+	first, last, err := dnsdbTimes(tr)
+	return dnsdbRData{
+		Count:     tr.Count,
+		TimeFirst: first,
+		TimeLast:  last,
+		RRName:    dnsdbName(tr.Query),
+		RRType:    tr.RRType,
+		RData:     dnsdbRDataValue(tr),
+	}, err
+}
+
+//dnsdbOptions reads the time fences, limit and offset the same way the
+//other endpoints do, plus the rrtype from the path. ANY, or no rrtype,
+//matches every type.
+func dnsdbOptions(req *http.Request) (SearchOptions, error) {
+	opts, err := requestSearchOptions(req, dnsdbDefaultLimit)
+	if err != nil {
+		return opts, err
+	}
+	rrtype := strings.ToUpper(mux.Vars(req)["type"])
+	if rrtype == "" || rrtype == "ANY" {
+		return opts, nil
+	}
+	if !validDNSDBRRType(rrtype) {
+		return opts, fmt.Errorf("invalid rrtype %q", rrtype)
+	}
+	opts.RRTypes = []string{rrtype}
+	return opts, nil
+}
+
+//dnsdbRRTypes are the mnemonics a lookup can be limited to. Types without
+//one can be given in the generic form, like TYPE65.
+var dnsdbRRTypes = map[string]bool{
+	"A": true, "A6": true, "AAAA": true, "AFSDB": true, "APL": true,
+	"CAA": true, "CDNSKEY": true, "CDS": true, "CERT": true, "CNAME": true,
+	"DHCID": true, "DLV": true, "DNAME": true, "DNSKEY": true, "DS": true,
+	"HINFO": true, "HIP": true, "HTTPS": true, "IPSECKEY": true, "KEY": true,
+	"KX": true, "LOC": true, "MX": true, "NAPTR": true, "NS": true,
+	"NSEC": true, "NSEC3": true, "NSEC3PARAM": true, "NULL": true, "OPENPGPKEY": true,
+	"PTR": true, "RP": true, "RRSIG": true, "SIG": true, "SMIMEA": true,
+	"SOA": true, "SPF": true, "SRV": true, "SSHFP": true, "SVCB": true,
+	"TLSA": true, "TXT": true, "URI": true, "WKS": true,
+}
+
+func validDNSDBRRType(rrtype string) bool {
+	if dnsdbRRTypes[rrtype] {
+		return true
+	}
+	if !strings.HasPrefix(rrtype, "TYPE") {
+		return false
+	}
+	n, err := strconv.ParseUint(rrtype[len("TYPE"):], 10, 16)
+	return err == nil && n > 0
+}
+
+//dnsdbIPRange turns the address, prefix or range of an rdata ip lookup
+//into one CIDRTuples takes. DNSDB writes prefixes like 10.1.0.0,16.
+func dnsdbIPRange(value string) (string, error) {
+	value = strings.Replace(value, ",", "/", 1)
+	if isIPRange(value) {
+		return value, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	if ip.To4() != nil {
+		return value + "/32", nil
+	}
+	return value + "/128", nil
+}
+
+//writeSAF writes the results of a lookup, obj converts each of them,
+//until the client goes away
+func writeSAF(w http.ResponseWriter, recs tupleResults, more bool, obj func(tupleResult) (interface{}, error)) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(safLine{Cond: "begin"})
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		o, err := obj(rec)
+		if err != nil {
+			return enc.Encode(safLine{Cond: "failed", Msg: err.Error()})
+		}
+		err = enc.Encode(safLine{Obj: o})
+		if err != nil {
+			return err
+		}
+	}
+	if more {
+		return enc.Encode(safLine{Cond: "limited", Msg: "Result limit reached"})
+	}
+	return enc.Encode(safLine{Cond: "succeeded"})
+}
+
+//dnsdbLookup runs a lookup and answers with its results
+func (h *pdnsHandler) dnsdbLookup(w http.ResponseWriter, req *http.Request, search func(string, SearchOptions) (tupleResults, error), value string, obj func(tupleResult) (interface{}, error)) {
+	opts, err := dnsdbOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs, more, err := tuplePage(search, value, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = writeSAF(w, recs, more, obj)
+	if err != nil {
+		log.Printf("Error writing SAF: %v", err)
+	}
+}
+
+//handleDNSDBRRsetName looks up the tuples for a query name, which can have
+//a wildcard on the left like *.example.com, or on the right like
+//www.example.*
+func (h *pdnsHandler) handleDNSDBRRsetName(w http.ResponseWriter, req *http.Request) {
+	h.dnsdbLookup(w, req, h.s.GlobQueryTuples, mux.Vars(req)["name"], dnsdbRRsetObj)
+}
+
+//handleDNSDBRDataName looks up the tuples with a name as their answer,
+//with the same wildcards
+func (h *pdnsHandler) handleDNSDBRDataName(w http.ResponseWriter, req *http.Request) {
+	h.dnsdbLookup(w, req, h.s.GlobAnswers, mux.Vars(req)["name"], dnsdbRDataObj)
+}
+
+func (h *pdnsHandler) handleDNSDBRDataIP(w http.ResponseWriter, req *http.Request) {
+	prefix, err := dnsdbIPRange(mux.Vars(req)["ip"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.dnsdbLookup(w, req, h.s.CIDRTuples, prefix, dnsdbRDataObj)
+}
+
+//mountDNSDB adds the DNSDB API v2 routes. ping and rate_limit are there
+//for clients that check them before searching, there is no rate limit.
+func (h *pdnsHandler) mountDNSDB(r *mux.Router) {
+	v2 := r.PathPrefix("/dnsdb/v2").Subrouter()
+	v2.HandleFunc("/lookup/rrset/name/{name}", h.handleDNSDBRRsetName)
+	v2.HandleFunc("/lookup/rrset/name/{name}/{type}", h.handleDNSDBRRsetName)
+	v2.HandleFunc("/lookup/rdata/name/{name}", h.handleDNSDBRDataName)
+	v2.HandleFunc("/lookup/rdata/name/{name}/{type}", h.handleDNSDBRDataName)
+	v2.HandleFunc("/lookup/rdata/ip/{ip:.+}", h.handleDNSDBRDataIP)
+	v2.HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"ping": "ok"})
+	})
+	v2.HandleFunc("/rate_limit", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rate": map[string]string{"limit": "unlimited", "remaining": "n/a", "reset": "n/a"},
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSDB(t *testing.T) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ag := NewDNSAggregator()
+	for query, answer := range map[string]string{
+		"www.example.com":  "10.1.2.3",
+		"mail.example.com": "10.1.2.4",
+		"cdn.example.org":  "edge.cloudfront.net",
+	} {
+		ag.AddRecord(DNSRecord{
+			ts:      time.Unix(1617580800, 0).UTC(),
+			query:   query,
+			qtype:   "A",
+			answers: []string{answer},
+			ttls:    []string{"300"},
+		})
+	}
+	_, err = store.Update(ag.GetResult())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(store, webConfig{dnsdb: true}))
+	defer srv.Close()
+
+	//lookup returns the conditions and the rrnames of the objects
+	lookup := func(path string) (int, []string, []string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var conds, names []string
+		scanner := bufio.NewScanner(resp.Body)
+		for resp.StatusCode == http.StatusOK && scanner.Scan() {
+			var line struct {
+				Cond string
+				Obj  struct {
+					RRName    string
+					TimeFirst int64 `json:"time_first"`
+				}
+			}
+			err = json.Unmarshal(scanner.Bytes(), &line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line.Cond != "" {
+				conds = append(conds, line.Cond)
+			} else {
+				assert.EqualValues(t, 1617580800, line.Obj.TimeFirst)
+				names = append(names, line.Obj.RRName)
+			}
+		}
+		return resp.StatusCode, conds, names
+	}
+
+	tests := []struct {
+		path  string
+		conds []string
+		names []string
+	}{
+		{"/dnsdb/v2/lookup/rrset/name/www.example.com", []string{"begin", "succeeded"}, []string{"www.example.com."}},
+		{"/dnsdb/v2/lookup/rrset/name/www.example.com./A", []string{"begin", "succeeded"}, []string{"www.example.com."}},
+		{"/dnsdb/v2/lookup/rrset/name/www.example.com/MX", []string{"begin", "succeeded"}, nil},
+		{"/dnsdb/v2/lookup/rrset/name/www.example.com/a", []string{"begin", "succeeded"}, []string{"www.example.com."}},
+		{"/dnsdb/v2/lookup/rrset/name/www.example.com/TYPE65", []string{"begin", "succeeded"}, nil},
+		{"/dnsdb/v2/lookup/rrset/name/*.example.com/ANY", []string{"begin", "succeeded"}, []string{"mail.example.com.", "www.example.com."}},
+		{"/dnsdb/v2/lookup/rrset/name/*.example.com?limit=1", []string{"begin", "limited"}, []string{"mail.example.com."}},
+		{"/dnsdb/v2/lookup/rrset/name/cdn.example.*", []string{"begin", "succeeded"}, []string{"cdn.example.org."}},
+		{"/dnsdb/v2/lookup/rdata/name/edge.cloudfront.net", []string{"begin", "succeeded"}, []string{"cdn.example.org."}},
+		{"/dnsdb/v2/lookup/rdata/name/*.cloudfront.net/CNAME", []string{"begin", "succeeded"}, []string{"cdn.example.org."}},
+		{"/dnsdb/v2/lookup/rdata/name/www.example.com", []string{"begin", "succeeded"}, nil},
+		{"/dnsdb/v2/lookup/rdata/ip/10.1.2.3", []string{"begin", "succeeded"}, []string{"www.example.com."}},
+		{"/dnsdb/v2/lookup/rdata/ip/10.1.2.0,24", []string{"begin", "succeeded"}, []string{"mail.example.com.", "www.example.com."}},
+		{"/dnsdb/v2/lookup/rdata/ip/10.1.2.0,24?time_last_before=1617580000", []string{"begin", "succeeded"}, nil},
+	}
+	for _, tt := range tests {
+		status, conds, names := lookup(tt.path)
+		assert.Equal(t, http.StatusOK, status, tt.path)
+		assert.Equal(t, tt.conds, conds, tt.path)
+		assert.ElementsMatch(t, tt.names, names, tt.path)
+	}
+
+	for _, path := range []string{
+		"/dnsdb/v2/lookup/rdata/ip/example.com",
+		"/dnsdb/v2/lookup/rrset/name/www.example.com/BOGUS",
+		"/dnsdb/v2/lookup/rrset/name/www.example.com/A')--",
+		"/dnsdb/v2/lookup/rrset/name/www.example.com/TYPE70000",
+	} {
+		status, _, _ := lookup(path)
+		assert.Equal(t, http.StatusBadRequest, status, path)
+	}
+
+	srv2 := httptest.NewServer(newRouter(store, webConfig{}))
+	defer srv2.Close()
+	resp, err := http.Get(srv2.URL + "/dnsdb/v2/lookup/rrset/name/www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+//failingWriter fails every write, like a client that went away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	fw.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestWriteSAFError(t *testing.T) {
+	recs := tupleResults{
+		{Query: "www.example.com", Type: "A", RRType: "A", Answer: "10.1.2.3", Count: 1, First: "2021-04-05 00:00:00", Last: "2021-04-05 00:00:00"},
+		{Query: "mail.example.com", Type: "A", RRType: "A", Answer: "10.1.2.4", Count: 1, First: "2021-04-05 00:00:00", Last: "2021-04-05 00:00:00"},
+	}
+	fw := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	err := writeSAF(fw, recs, false, dnsdbRRsetObj)
+	assert.Error(t, err)
+	assert.Equal(t, 1, fw.writes)
+}
+
+func TestDNSDBIPRange(t *testing.T) {
+	for value, want := range map[string]string{
+		"10.1.2.3":            "10.1.2.3/32",
+		"10.1.0.0,16":         "10.1.0.0/16",
+		"10.1.0.0/16":         "10.1.0.0/16",
+		"10.1.0.0-10.1.3.255": "10.1.0.0-10.1.3.255",
+		"2001:db8::1":         "2001:db8::1/128",
+	} {
+		got, err := dnsdbIPRange(value)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, want, got, value)
+		}
+	}
+	_, err := dnsdbIPRange("example.com")
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//parseFence parses the time given for a time fence. Like dnsdb a negative
+//number of seconds is relative to now, and so is a negative duration like
+//-24h. Anything else is a timestamp, or a date which means midnight UTC.
+func parseFence(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if strings.HasPrefix(value, "-") {
+		if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return now.Add(time.Duration(sec) * time.Second).UTC(), nil
+		}
+		if d, err := time.ParseDuration(value); err == nil {
+			return now.Add(d).UTC(), nil
+		}
+	}
+	if ts, err := time.Parse("2006-01-02", value); err == nil {
+		return ts, nil
+	}
+	if ts, err := parseTimestamp(value); err == nil {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+//timeFences returns the conditions for the time fences in opts on when a
+//record was first and last seen, joined with AND, or "" if there are none.
+//timeArg adds a time as an argument in the form the store compares them.
+func timeFences(b *sqlBuilder, first string, last string, opts SearchOptions, timeArg func(*sqlBuilder, time.Time) string) string {
+	var conds []string
+	add := func(column string, op string, t time.Time) {
+		if !t.IsZero() {
+			conds = append(conds, column+op+timeArg(b, t))
+		}
+	}
+	add(first, " > ", opts.FirstAfter)
+	add(first, " < ", opts.FirstBefore)
+	add(last, " > ", opts.LastAfter)
+	add(last, " < ", opts.LastBefore)
+	return strings.Join(conds, " AND ")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFence(t *testing.T) {
+	now := time.Date(2021, 4, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"2021-04-05", time.Date(2021, 4, 5, 0, 0, 0, 0, time.UTC)},
+		{"2021-04-05T10:30:00Z", time.Date(2021, 4, 5, 10, 30, 0, 0, time.UTC)},
+		{"2021-04-05T10:30:00-04:00", time.Date(2021, 4, 5, 14, 30, 0, 0, time.UTC)},
+		{"1617618600", time.Date(2021, 4, 5, 10, 30, 0, 0, time.UTC)},
+		{"-86400", time.Date(2021, 4, 9, 12, 0, 0, 0, time.UTC)},
+		{"-36h", time.Date(2021, 4, 9, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseFence(tt.value, now)
+		if assert.NoError(t, err, tt.value) {
+			assert.Equal(t, tt.want, got, tt.value)
+		}
+	}
+	for _, value := range []string{"yesterday", "-1x", "2021-13-01"} {
+		_, err := parseFence(value, now)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const followChunkSize = 64 * 1024
+
+//followState is what gets saved after every flush so a restarted follower
+//can pick up where it left off. The fingerprint identifies the file by its
+//first line, which for zeek logs contains the #open time or the first
+//record, so a log that was rotated while we were down isn't resumed.
+type followState struct {
+	Path        string `json:"path"`
+	Fingerprint string `json:"fingerprint"`
+	Offset      int64  `json:"offset"`
+}
+
+//follower tails a live zeek dns log, like current/dns.log, aggregating
+//records as they are written and periodically flushing them to the store.
+type follower struct {
+	store         Store
+	sensor        string
+	path          string
+	stateFile     string
+	flushInterval time.Duration
+	flushRecords  uint
+	pollInterval  time.Duration
+
+	f           *os.File
+	fi          os.FileInfo
+	fingerprint string
+	offset      int64 // end of the last complete line that was read
+	partial     []byte
+	buf         bytes.Buffer
+	reader      Reader
+	agg         *DNSAggregator
+	lastFlush   time.Time
+}
+
+func newFollower(store Store, path string, stateFile string) *follower {
+	return &follower{
+		store:         store,
+		path:          path,
+		stateFile:     stateFile,
+		flushInterval: 60 * time.Second,
+		flushRecords:  100000,
+		pollInterval:  time.Second,
+		agg:           NewDNSAggregator(),
+		lastFlush:     time.Now(),
+	}
+}
+
+func readFingerprint(f *os.File) (string, error) {
+	first := make([]byte, 4096)
+	n, err := f.ReadAt(first, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	idx := bytes.IndexByte(first[:n], '\n')
+	if idx == -1 {
+		//No complete first line yet
+		return "", nil
+	}
+	sum := sha256.Sum256(first[:idx])
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (fl *follower) loadState() (followState, error) {
+	var state followState
+	data, err := ioutil.ReadFile(fl.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (fl *follower) saveState() error {
+	if fl.fingerprint == "" && fl.f != nil {
+		fp, err := readFingerprint(fl.f)
+		if err != nil {
+			return err
+		}
+		fl.fingerprint = fp
+	}
+	state := followState{
+		Path:        fl.path,
+		Fingerprint: fl.fingerprint,
+		Offset:      fl.offset,
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	//Write then rename so a crash never leaves a half written state file
+	tmp, err := ioutil.TempFile(filepath.Dir(fl.stateFile), ".follow-state")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fl.stateFile)
+}
+
+//open opens the log. When resume is set and the saved state refers to the
+//same file, reading continues from the saved offset.
+func (fl *follower) open(resume bool) error {
+	f, err := os.Open(fl.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	fp, err := readFingerprint(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fl.f != nil {
+		fl.f.Close()
+	}
+	fl.f = f
+	fl.fi = fi
+	fl.fingerprint = fp
+	fl.resetReader()
+	fl.offset = 0
+
+	if !resume {
+		return nil
+	}
+	state, err := fl.loadState()
+	if err != nil {
+		return fmt.Errorf("Unable to load follow state from %s: %w", fl.stateFile, err)
+	}
+	if state.Offset == 0 || state.Path != fl.path || state.Fingerprint != fp || state.Offset > fi.Size() {
+		if state.Offset != 0 {
+			log.Printf("%s: saved state is for a different file, starting from the beginning", fl.path)
+		}
+		return nil
+	}
+	//Records after the offset still need the ascii header to be parsed
+	err = fl.feedHeader()
+	if err != nil {
+		return err
+	}
+	_, err = fl.f.Seek(state.Offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	fl.offset = state.Offset
+	log.Printf("%s: resuming at offset %d", fl.path, fl.offset)
+	return nil
+}
+
+//feedHeader feeds the leading # lines of the file to the reader
+func (fl *follower) feedHeader() error {
+	_, err := fl.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, followChunkSize)
+	n, err := fl.f.Read(data)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	data = data[:n]
+	var header []byte
+	for len(data) > 0 && data[0] == '#' {
+		idx := bytes.IndexByte(data, '\n')
+		if idx == -1 {
+			break
+		}
+		header = append(header, data[:idx+1]...)
+		data = data[idx+1:]
+	}
+	return fl.feed(header)
+}
+
+func (fl *follower) resetReader() {
+	fl.buf.Reset()
+	fl.partial = nil
+	fl.reader = nil
+}
+
+//feed parses complete lines and adds them to the current aggregator
+func (fl *follower) feed(lines []byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	fl.buf.Write(lines)
+	if fl.reader == nil {
+		reader, err := NewBroReader(&fl.buf)
+		if err != nil {
+			return err
+		}
+		fl.reader = reader
+	}
+	for {
+		rec, err := fl.reader.Next()
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			return nil
+		}
+		err = aggregateRecord(fl.agg, rec)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//readChunk reads whatever is available from the log, up to one chunk, and
+//returns the number of bytes read. A trailing partial line is held back
+//until the rest of it has been written.
+func (fl *follower) readChunk() (int, error) {
+	data := make([]byte, followChunkSize)
+	n, err := fl.f.Read(data)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	data = append(fl.partial, data[:n]...)
+	idx := bytes.LastIndexByte(data, '\n')
+	if idx == -1 {
+		fl.partial = data
+		return n, nil
+	}
+	fl.partial = append([]byte(nil), data[idx+1:]...)
+	err = fl.feed(data[:idx+1])
+	if err != nil {
+		return n, err
+	}
+	fl.offset += int64(idx + 1)
+	return n, nil
+}
+
+//drain reads until the end of the currently open file
+func (fl *follower) drain() error {
+	for {
+		n, err := fl.readChunk()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
+
+//checkRotation looks for the log being truncated or replaced by a new file.
+//When that happens the rest of the old file is flushed and the new file is
+//read from the beginning.
+func (fl *follower) checkRotation() (bool, error) {
+	fi, err := os.Stat(fl.path)
+	if errors.Is(err, os.ErrNotExist) {
+		//Between zeek moving the old log away and creating the new one
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(fl.fi, fi) {
+		log.Printf("%s: log was rotated", fl.path)
+		err = fl.drain()
+		if err != nil {
+			return true, err
+		}
+		if len(fl.partial) > 0 {
+			log.Printf("%s: discarding %d bytes of incomplete line at end of rotated log", fl.path, len(fl.partial))
+		}
+		err = fl.flush()
+		if err != nil {
+			return true, err
+		}
+		return true, fl.open(false)
+	}
+	if fi.Size() < fl.offset {
+		log.Printf("%s: log was truncated", fl.path)
+		err = fl.flush()
+		if err != nil {
+			return true, err
+		}
+		return true, fl.open(false)
+	}
+	return false, nil
+}
+
+func (fl *follower) flushDue() bool {
+	return fl.agg.totalRecords+fl.agg.skippedRecords >= fl.flushRecords ||
+		time.Since(fl.lastFlush) >= fl.flushInterval
+}
+
+//flush writes everything aggregated so far to the store and then saves the
+//offset it corresponds to
+func (fl *follower) flush() error {
+	aggregated := fl.agg.GetResult()
+	aggregated.Sensor = fl.sensor
+	if aggregated.TotalRecords > 0 {
+		result, err := fl.store.Update(aggregated)
+		if err != nil {
+			return fmt.Errorf("store.Update: %w", err)
+		}
+		log.Printf("%s: Flush: TotalRecords=%d SkippedRecords=%d Tuples=%d Individual=%d Duration=%0.1f Inserted=%d Updated=%d",
+			fl.path,
+			aggregated.TotalRecords,
+			aggregated.SkippedRecords,
+			aggregated.TuplesLen,
+			aggregated.IndividualLen,
+			result.Duration.Seconds(),
+			result.Inserted,
+			result.Updated,
+		)
+	}
+	fl.agg = NewDNSAggregator()
+	fl.lastFlush = time.Now()
+	return fl.saveState()
+}
+
+//run follows the log until ctx is cancelled, flushing before returning
+func (fl *follower) run(ctx context.Context) error {
+	err := fl.open(true)
+	if err != nil {
+		return err
+	}
+	defer fl.f.Close()
+	for {
+		n, err := fl.readChunk()
+		if err != nil {
+			return err
+		}
+		if fl.flushDue() {
+			err = fl.flush()
+			if err != nil {
+				return err
+			}
+		}
+		if n > 0 {
+			select {
+			case <-ctx.Done():
+				return fl.flush()
+			default:
+				continue
+			}
+		}
+		rotated, err := fl.checkRotation()
+		if err != nil {
+			return err
+		}
+		if rotated {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return fl.flush()
+		case <-time.After(fl.pollInterval):
+		}
+	}
+}
+
+func follow(store Store, sensor string, path string, stateFile string, flushInterval time.Duration, flushRecords uint) error {
+	ctx, cancel := signalContext()
+	defer cancel()
+	fl := newFollower(store, path, stateFile)
+	fl.sensor = sensor
+	fl.flushInterval = flushInterval
+	fl.flushRecords = flushRecords
+	return fl.run(ctx)
+}
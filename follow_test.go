@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFollower(t *testing.T, dir string) (*follower, Store) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFollower(store, filepath.Join(dir, "dns.log"), filepath.Join(dir, "state.json")), store
+}
+
+func appendLines(t *testing.T, fn string, lines []string) {
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, l := range lines {
+		_, err = f.WriteString(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestLog(t *testing.T, fn string) (header []string, records []string) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, "#close") || line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			header = append(header, line)
+		} else {
+			records = append(records, line)
+		}
+	}
+	return header, records
+}
+
+//queryCount counts the records in lines that are for reddit.com
+func queryCount(lines []string) uint {
+	var count uint
+	for _, l := range lines {
+		if strings.Split(l, "\t")[8] == "reddit.com" {
+			count++
+		}
+	}
+	return count
+}
+
+func followCount(t *testing.T, s Store, value string) uint {
+	recs, err := s.FindIndividual(value, SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) == 0 {
+		return 0
+	}
+	return recs[0].Count
+}
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header, records := readTestLog(t, "test_data/reddit_dns_2016-04-01.log")
+	fl, store := newTestFollower(t, dir)
+
+	appendLines(t, fl.path, header)
+	appendLines(t, fl.path, records[:2])
+	//A partial line should be held back until it is complete
+	half := len(records[2]) / 2
+	appendLines(t, fl.path, []string{records[2][:half]})
+
+	assert.NoError(t, fl.open(true))
+	assert.NoError(t, fl.drain())
+	assert.NoError(t, fl.flush())
+	assert.EqualValues(t, 1, followCount(t, store, "www.reddit.com"))
+	assert.EqualValues(t, 1, followCount(t, store, "reddit.com"))
+	total := queryCount(records)
+
+	appendLines(t, fl.path, []string{records[2][half:]})
+	appendLines(t, fl.path, records[3:])
+	assert.NoError(t, fl.drain())
+	assert.NoError(t, fl.flush())
+	assert.EqualValues(t, total, followCount(t, store, "reddit.com"))
+
+	//A restarted follower resumes from the saved offset
+	fl2 := newFollower(store, fl.path, fl.stateFile)
+	assert.NoError(t, fl2.open(true))
+	assert.Equal(t, fl.offset, fl2.offset)
+	appendLines(t, fl.path, records[:2])
+	assert.NoError(t, fl2.drain())
+	assert.NoError(t, fl2.flush())
+	assert.EqualValues(t, total+1, followCount(t, store, "reddit.com"))
+
+	//Rotation: the old log is moved away and a new one started
+	assert.NoError(t, os.Rename(fl.path, filepath.Join(dir, "dns.old.log")))
+	appendLines(t, fl.path, []string{"#separator \\x09\n", "#open\t2016-04-02-00-00-00\n"})
+	appendLines(t, fl.path, header[1:])
+	appendLines(t, fl.path, records[:2])
+	rotated, err := fl2.checkRotation()
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	assert.NoError(t, fl2.drain())
+	assert.NoError(t, fl2.flush())
+	assert.EqualValues(t, total+2, followCount(t, store, "reddit.com"))
+
+	//Truncation starts over at the beginning of the same file
+	assert.NoError(t, os.Truncate(fl.path, 0))
+	appendLines(t, fl.path, header)
+	rotated, err = fl2.checkRotation()
+	assert.NoError(t, err)
+	assert.True(t, rotated)
+	appendLines(t, fl.path, records[:2])
+	assert.NoError(t, fl2.drain())
+	assert.NoError(t, fl2.flush())
+	assert.EqualValues(t, total+3, followCount(t, store, "reddit.com"))
+}
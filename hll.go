@@ -0,0 +1,193 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+//hllPrecision is the number of hash bits used to pick a register. 4096
+//registers give an error of about 1.6%.
+const hllPrecision = 12
+const hllRegisters = 1 << hllPrecision
+
+//hllSparseMax is the number of registers that are kept in a sorted list
+//before switching to an array of all of them. Most tuples are only ever
+//seen by a handful of clients.
+const hllSparseMax = hllRegisters / 4
+
+//hll is a HyperLogLog sketch used to estimate the number of distinct
+//clients that looked up a tuple or value. Sketches are stored as a list of
+//3 byte entries, the register number and its value, for every non zero
+//register, sorted by register. Sketches are read as the union of all their
+//entries, so concatenated sketches are one too.
+type hll struct {
+	sparse []uint32 // register<<8 | value
+	dense  []uint8
+}
+
+func newHLL() *hll {
+	return &hll{}
+}
+
+func parseHLL(b []byte) *hll {
+	h := newHLL()
+	for i := 0; i+2 < len(b); i += 3 {
+		h.set(uint16(b[i])<<8|uint16(b[i+1]), b[i+2])
+	}
+	return h
+}
+
+//hash64 is fnv followed by the murmur3 finalizer, fnv on its own doesn't
+//spread similar inputs like IP addresses over the high bits well enough
+func hash64(value string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(value))
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (h *hll) add(value string) {
+	x := hash64(value)
+	reg := uint16(x >> (64 - hllPrecision))
+	rho := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	h.set(reg, rho)
+}
+
+func (h *hll) set(reg uint16, rho uint8) {
+	if reg >= hllRegisters || rho == 0 {
+		return
+	}
+	if h.dense != nil {
+		if rho > h.dense[reg] {
+			h.dense[reg] = rho
+		}
+		return
+	}
+	idx := sort.Search(len(h.sparse), func(i int) bool {
+		return uint16(h.sparse[i]>>8) >= reg
+	})
+	entry := uint32(reg)<<8 | uint32(rho)
+	if idx < len(h.sparse) && uint16(h.sparse[idx]>>8) == reg {
+		if rho > uint8(h.sparse[idx]) {
+			h.sparse[idx] = entry
+		}
+		return
+	}
+	h.sparse = append(h.sparse, 0)
+	copy(h.sparse[idx+1:], h.sparse[idx:])
+	h.sparse[idx] = entry
+	if len(h.sparse) > hllSparseMax {
+		h.dense = make([]uint8, hllRegisters)
+		for _, e := range h.sparse {
+			h.dense[e>>8] = uint8(e)
+		}
+		h.sparse = nil
+	}
+}
+
+//each calls fn for every non zero register, in order
+func (h *hll) each(fn func(reg uint16, rho uint8)) {
+	if h.dense != nil {
+		for reg, rho := range h.dense {
+			if rho != 0 {
+				fn(uint16(reg), rho)
+			}
+		}
+		return
+	}
+	for _, e := range h.sparse {
+		fn(uint16(e>>8), uint8(e))
+	}
+}
+
+func (h *hll) merge(other *hll) {
+	other.each(h.set)
+}
+
+func (h *hll) estimate() uint64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	nonZero := 0
+	h.each(func(reg uint16, rho uint8) {
+		sum += math.Pow(2, -float64(rho))
+		nonZero++
+	})
+	zeros := hllRegisters - nonZero
+	sum += float64(zeros)
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	//Linear counting is much more accurate while most registers are unset
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(e))
+}
+
+//bytes returns the stored form of the sketch. It is never nil so it is
+//stored as an empty blob rather than NULL.
+func (h *hll) bytes() []byte {
+	b := []byte{}
+	if h == nil {
+		return b
+	}
+	h.each(func(reg uint16, rho uint8) {
+		b = append(b, byte(reg>>8), byte(reg), rho)
+	})
+	return b
+}
+
+//registers returns the non zero registers as two arrays, for clickhouse's
+//maxMap. The values are widened since a []uint8 would be sent as a string.
+func (h *hll) registers() ([]uint16, []uint16) {
+	regs := []uint16{}
+	rhos := []uint16{}
+	if h == nil {
+		return regs, rhos
+	}
+	h.each(func(reg uint16, rho uint8) {
+		regs = append(regs, reg)
+		rhos = append(rhos, uint16(rho))
+	})
+	return regs, rhos
+}
+
+//hllUnion and hllCount are registered as sqlite functions. Missing
+//sketches are NULL, which shows up here as nil.
+func hllUnion(a, b interface{}) []byte {
+	ab, _ := a.([]byte)
+	bb, _ := b.([]byte)
+	h := parseHLL(ab)
+	h.merge(parseHLL(bb))
+	return h.bytes()
+}
+
+func hllCount(a interface{}) int64 {
+	ab, _ := a.([]byte)
+	return int64(parseHLL(ab).estimate())
+}
+
+//hllAggregator is the sqlite hll_union_agg aggregate, for merging the
+//sketches of several rows
+type hllAggregator struct {
+	h *hll
+}
+
+func newHLLAggregator() *hllAggregator {
+	return &hllAggregator{h: newHLL()}
+}
+
+func (a *hllAggregator) Step(sketch interface{}) {
+	b, _ := sketch.([]byte)
+	a.h.merge(parseHLL(b))
+}
+
+func (a *hllAggregator) Done() []byte {
+	return a.h.bytes()
+}
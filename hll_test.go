@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHLLEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000} {
+		h := newHLL()
+		for i := 0; i < n; i++ {
+			ip := fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+			h.add(ip)
+			//Duplicates don't count
+			h.add(ip)
+		}
+		est := float64(h.estimate())
+		assert.InDelta(t, float64(n), est, float64(n)*0.05+0.5, "n=%d", n)
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	a := newHLL()
+	b := newHLL()
+	both := newHLL()
+	for i := 0; i < 3000; i++ {
+		ip := fmt.Sprintf("192.168.%d.%d", i>>8, i&255)
+		if i < 2000 {
+			a.add(ip)
+		}
+		if i >= 1000 {
+			b.add(ip)
+		}
+		both.add(ip)
+	}
+	//a is dense by now and b still sparse, merging either way around has
+	//to give the same registers as adding everything to one sketch
+	a.merge(b)
+	assert.Equal(t, both.bytes(), a.bytes())
+	assert.Equal(t, both.estimate(), a.estimate())
+
+	//Round trip through the stored form, and the sqlite functions
+	assert.Equal(t, both.bytes(), parseHLL(both.bytes()).bytes())
+	assert.Equal(t, both.bytes(), hllUnion(a.bytes(), nil))
+	assert.EqualValues(t, both.estimate(), hllCount(hllUnion(parseHLL(nil).bytes(), both.bytes())))
+	assert.EqualValues(t, 0, hllCount(nil))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//importFormats are the formats import reads. cof is the passive DNS Common
+//Output Format, dnsdb is DNSDB API output in either the v1 format or the v2
+//SAF one, and ndjson is the tuples and individual values this tool outputs.
+var importFormats = []string{"cof", "dnsdb", "ndjson"}
+
+func validImportFormat(format string) bool {
+	for _, f := range importFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+//importRData is the rdata of a record, which can be a single value or a
+//list of them
+type importRData []string
+
+func (rd *importRData) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err == nil {
+		*rd = values
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*rd = importRData{value}
+	return nil
+}
+
+//pdnsRecord is a COF or DNSDB record. DNSDB records for data from zone
+//files only have the zone times.
+type pdnsRecord struct {
+	RRName        string      `json:"rrname"`
+	RRType        string      `json:"rrtype"`
+	RData         importRData `json:"rdata"`
+	Count         uint        `json:"count"`
+	TimeFirst     float64     `json:"time_first"`
+	TimeLast      float64     `json:"time_last"`
+	ZoneTimeFirst float64     `json:"zone_time_first"`
+	ZoneTimeLast  float64     `json:"zone_time_last"`
+}
+
+//dnsdbImportLine is a line of DNSDB output. v2 wraps every record in a SAF
+//line, while v1 records are bare.
+type dnsdbImportLine struct {
+	pdnsRecord
+	Cond string      `json:"cond"`
+	Msg  string      `json:"msg"`
+	Obj  *pdnsRecord `json:"obj"`
+}
+
+//ndjsonRecord is a tuple, individual value or rcode as output by find and
+//like, or by the aggregator. ttl is a string in some of them and a number
+//in others.
+type ndjsonRecord struct {
+	Query      string      `json:"query"`
+	Original   string      `json:"original"`
+	Type       string      `json:"type"`
+	RRType     string      `json:"rrtype"`
+	Answer     string      `json:"answer"`
+	Rcode      string      `json:"rcode"`
+	Which      string      `json:"which"`
+	Value      string      `json:"value"`
+	TTL        interface{} `json:"ttl"`
+	Count      uint        `json:"count"`
+	First      string      `json:"first"`
+	Last       string      `json:"last"`
+	ClientsHLL []byte      `json:"clients_hll"`
+}
+
+func epochTime(sec float64) time.Time {
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC()
+}
+
+func importTTL(ttl interface{}) string {
+	switch v := ttl.(type) {
+	case string:
+		return stripDecimal(v)
+	case float64:
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return "0"
+}
+
+//importer turns exported records into aggregated tuples and individual
+//values. Formats that only have tuples get their individual values from
+//the tuples, while an ndjson export that has its own keeps those.
+type importer struct {
+	aggregator *DNSAggregator
+	derived    *DNSAggregator
+	individual bool
+}
+
+func newImporter(aggregator *DNSAggregator) *importer {
+	return &importer{aggregator: aggregator, derived: NewDNSAggregator()}
+}
+
+func (im *importer) skip(format string, args ...interface{}) {
+	log.Printf("Skipping "+format, args...)
+	im.aggregator.SkipRecord()
+}
+
+func (im *importer) addTuple(query string, qtype string, rrtype string, answer string, stat queryStat) {
+	if len(query) > MAX_SANE_VALUE_LEN || len(answer) > MAX_SANE_VALUE_LEN {
+		im.skip("record with insane length: %q %q", query, answer)
+		return
+	}
+	if stat.count == 0 {
+		stat.count = 1
+	}
+	//Exports and pushed batches can claim any type, but the stores need A
+	//and AAAA answers to be addresses
+	if rrtype == "A" || rrtype == "AAAA" {
+		rrtype = answerType(rrtype, answer, false)
+	}
+	normalized := normalizeName(query)
+	stat.setOriginal(query, normalized)
+	if isNameType(rrtype) {
+		answer = normalizeName(answer)
+	}
+	im.aggregator.totalRecords++
+	im.aggregator.addTuple(uniqueTuple{query: normalized, answer: answer, qtype: qtype, rrtype: rrtype}, stat)
+	if im.individual {
+		return
+	}
+
+	qstat := stat
+	qstat.ttl = ""
+	im.derived.addIndividual(uniqueIndividual{value: normalized, which: "Q"}, qstat)
+	astat := stat
+	astat.original = ""
+	im.derived.addIndividual(uniqueIndividual{value: answer, which: "A"}, astat)
+}
+
+func (im *importer) addPDNS(rec pdnsRecord) {
+	first, last := rec.TimeFirst, rec.TimeLast
+	if first == 0 && last == 0 {
+		first, last = rec.ZoneTimeFirst, rec.ZoneTimeLast
+	}
+	if first == 0 && last == 0 {
+		im.skip("record without times: %s %s", rec.RRName, rec.RRType)
+		return
+	}
+	if first == 0 {
+		first = last
+	} else if last == 0 {
+		last = first
+	}
+	rrtype := strings.ToUpper(rec.RRType)
+	stat := queryStat{count: rec.Count, first: epochTime(first), last: epochTime(last), ttl: "0"}
+	for _, rdata := range rec.RData {
+		im.addTuple(rec.RRName, rrtype, rrtype, rdata, stat)
+	}
+}
+
+func (im *importer) addDNSDB(line dnsdbImportLine) error {
+	switch {
+	case line.Obj != nil:
+		im.addPDNS(*line.Obj)
+	case line.Cond == "failed":
+		return fmt.Errorf("export failed: %s", line.Msg)
+	case line.Cond != "":
+		//begin, succeeded and limited only mark where the results are
+	default:
+		im.addPDNS(line.pdnsRecord)
+	}
+	return nil
+}
+
+func (im *importer) addNDJSON(rec ndjsonRecord) {
+	first, err := parseTimestamp(rec.First)
+	if err != nil {
+		im.skip("record with invalid first time: %v", err)
+		return
+	}
+	last, err := parseTimestamp(rec.Last)
+	if err != nil {
+		im.skip("record with invalid last time: %v", err)
+		return
+	}
+	stat := queryStat{count: rec.Count, first: first, last: last, original: rec.Original}
+	if stat.count == 0 {
+		stat.count = 1
+	}
+	if len(rec.ClientsHLL) > 0 {
+		stat.clients = parseHLL(rec.ClientsHLL)
+	}
+	switch {
+	case rec.Which != "":
+		value := rec.Value
+		if rec.Which == "Q" {
+			value = normalizeName(value)
+		}
+		im.individual = true
+		im.aggregator.addIndividual(uniqueIndividual{value: value, which: rec.Which}, stat)
+	case rec.Rcode != "":
+		im.aggregator.addRcode(uniqueRcode{query: normalizeName(rec.Query), qtype: rec.Type, rcode: rec.Rcode}, stat)
+	default:
+		qtype, rrtype := rec.Type, rec.RRType
+		if rrtype == "" {
+			rrtype = answerType(qtype, rec.Answer, false)
+		}
+		if qtype == "" {
+			qtype = rrtype
+		}
+		stat.ttl = importTTL(rec.TTL)
+		im.addTuple(rec.Query, qtype, rrtype, rec.Answer, stat)
+	}
+}
+
+//finish adds the individual values that came from the tuples, unless the
+//export had its own
+func (im *importer) finish() {
+	if !im.individual {
+		im.aggregator.Merge(im.derived)
+	}
+}
+
+//decode adds every record read from dec until the end of the input
+func (im *importer) decode(dec *json.Decoder, format string, name string) error {
+	for {
+		var err error
+		switch format {
+		case "cof":
+			var rec pdnsRecord
+			if err = dec.Decode(&rec); err == nil {
+				im.addPDNS(rec)
+			}
+		case "dnsdb":
+			var line dnsdbImportLine
+			if err = dec.Decode(&line); err == nil {
+				err = im.addDNSDB(line)
+			}
+		case "ndjson":
+			var rec ndjsonRecord
+			if err = dec.Decode(&rec); err == nil {
+				im.addNDJSON(rec)
+			}
+		default:
+			return fmt.Errorf("unknown import format %q", format)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+}
+
+func importFile(aggregator *DNSAggregator, fn string, format string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return importReader(aggregator, f, format, fn)
+}
+
+//importReader aggregates the records of an export in format from r. Like
+//aggregateReader compression is detected from the data and name is only
+//used for log messages.
+func importReader(aggregator *DNSAggregator, r io.Reader, format string, name string) error {
+	dr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	im := newImporter(aggregator)
+	err = im.decode(json.NewDecoder(dr), format, name)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("Possible truncated file %s: %v", name, err)
+	} else if err != nil {
+		return err
+	}
+	im.finish()
+	return nil
+}
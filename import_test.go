@@ -0,0 +1,169 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func importString(t *testing.T, format string, data string) aggregationResult {
+	aggregator := NewDNSAggregator()
+	err := importReader(aggregator, strings.NewReader(data), format, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aggregator.GetResult()
+}
+
+func findTupleResult(recs tupleResults, answer string) *tupleResult {
+	for i, rec := range recs {
+		if rec.Answer == answer {
+			return &recs[i]
+		}
+	}
+	return nil
+}
+
+func findAggregatedIndividual(ar aggregationResult, which string, value string) *aggregatedIndividual {
+	for i, ind := range ar.Individual {
+		if ind.which == which && ind.value == value {
+			return &ar.Individual[i]
+		}
+	}
+	return nil
+}
+
+func TestImportFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		data   string
+	}{
+		{"cof", `{"rrname":"WWW.Example.com.","rrtype":"CNAME","rdata":"Web.Example.com.","time_first":1459468800,"time_last":1459555200,"count":3}
+{"rrname":"www.example.com","rrtype":"cname","rdata":["web.example.com"],"time_first":1459382400,"time_last":1459468800,"count":2}
+`},
+		{"dnsdb", `{"cond":"begin"}
+{"obj":{"count":3,"time_first":1459468800,"time_last":1459555200,"rrname":"WWW.Example.com.","rrtype":"CNAME","bailiwick":"example.com.","rdata":["Web.Example.com."]}}
+{"obj":{"count":2,"zone_time_first":1459382400,"zone_time_last":1459468800,"rrname":"www.example.com.","rrtype":"CNAME","rdata":["web.example.com."]}}
+{"cond":"succeeded"}
+`},
+		{"ndjson", `{"query":"WWW.Example.com","type":"A","rrtype":"CNAME","answer":"web.example.com","ttl":"300","count":3,"first":"2016-04-01T00:00:00Z","last":"2016-04-02T00:00:00Z"}
+{"Query":"www.example.com","Type":"A","RRType":"CNAME","Answer":"web.example.com","TTL":300,"Count":2,"First":"2016-03-31 00:00:00","Last":"2016-04-01 00:00:00"}
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			ar := importString(t, tt.format, tt.data)
+			assert.Equal(t, uint(2), ar.TotalRecords)
+			if assert.Len(t, ar.Tuples, 1) {
+				tup := ar.Tuples[0]
+				assert.Equal(t, "www.example.com", tup.query)
+				assert.Equal(t, "web.example.com", tup.answer)
+				assert.Equal(t, "CNAME", tup.rrtype)
+				assert.Equal(t, uint(5), tup.count)
+				assert.Equal(t, int64(1459382400), tup.first.Unix())
+				assert.Equal(t, int64(1459555200), tup.last.Unix())
+			}
+			q := findAggregatedIndividual(ar, "Q", "www.example.com")
+			if assert.NotNil(t, q) {
+				assert.Equal(t, uint(5), q.count)
+			}
+			assert.NotNil(t, findAggregatedIndividual(ar, "A", "web.example.com"))
+		})
+	}
+}
+
+func TestImportNDJSONIndividual(t *testing.T) {
+	//Individual values in the export are kept instead of being worked out
+	//from the tuples
+	ar := importString(t, "ndjson", `{"query":"example.com","type":"A","rrtype":"A","answer":"1.2.3.4","ttl":"60","count":4,"first":"2016-04-01T00:00:00Z","last":"2016-04-01T00:00:00Z"}
+{"value":"example.com","which":"Q","count":7,"first":"2016-04-01T00:00:00Z","last":"2016-04-01T00:00:00Z"}
+{"query":"example.com","type":"A","rcode":"NOERROR","count":7,"first":"2016-04-01T00:00:00Z","last":"2016-04-01T00:00:00Z"}
+`)
+	assert.Len(t, ar.Tuples, 1)
+	assert.Len(t, ar.Rcodes, 1)
+	if assert.Len(t, ar.Individual, 1) {
+		assert.Equal(t, uint(7), ar.Individual[0].count)
+	}
+}
+
+func TestImportAddressTypes(t *testing.T) {
+	//A and AAAA answers that aren't addresses would fail to be stored
+	ar := importString(t, "cof", `{"rrname":"example.com","rrtype":"A","rdata":["x","2001:db8::1","Web.Example.com."],"time_first":1459468800,"time_last":1459468800}`)
+	types := make(map[string]string)
+	for _, tup := range ar.Tuples {
+		types[tup.answer] = tup.rrtype
+	}
+	assert.Equal(t, map[string]string{"x": "CNAME", "2001:db8::1": "AAAA", "web.example.com": "CNAME"}, types)
+}
+
+func TestImportInvalid(t *testing.T) {
+	ar := importString(t, "cof", `{"rrname":"example.com","rrtype":"A","rdata":"1.2.3.4","count":1}`)
+	assert.Equal(t, uint(1), ar.SkippedRecords)
+	assert.Len(t, ar.Tuples, 0)
+
+	err := importReader(NewDNSAggregator(), strings.NewReader(`{"cond":"failed","msg":"Query timed out"}`), "dnsdb", "dnsdb")
+	assert.Error(t, err)
+	err = importReader(NewDNSAggregator(), strings.NewReader(`{}`), "csv", "csv")
+	assert.Error(t, err)
+}
+
+func TestImport(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			LoadFile(t, store, "test_data/reddit_1.txt")
+			before, err := store.FindTuples("www.reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := findTupleResult(before, "198.41.209.142")
+			if !assert.NotNil(t, old) {
+				return
+			}
+			oldFirst, _ := cofTime(old.First)
+			oldLast, _ := cofTime(old.Last)
+
+			//A record from long before the logs, one from long after and
+			//a new tuple
+			cof := `{"rrname":"www.reddit.com","rrtype":"A","rdata":"198.41.209.142","time_first":1262304000,"time_last":1262304000,"count":10}
+{"rrname":"www.reddit.com","rrtype":"A","rdata":"198.41.209.142","time_first":1893456000,"time_last":1893456000,"count":5}
+{"rrname":"old.reddit.com","rrtype":"A","rdata":"10.0.0.1","time_first":1262304000,"time_last":1262304000,"count":1}
+`
+			err = indexSources(store, "", []logSource{{reader: strings.NewReader(cof), format: "cof"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := store.FindTuples("www.reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, after, len(before))
+			tup := findTupleResult(after, "198.41.209.142")
+			if assert.NotNil(t, tup) {
+				assert.Equal(t, old.Count+15, tup.Count)
+				first, _ := cofTime(tup.First)
+				last, _ := cofTime(tup.Last)
+				assert.Equal(t, int64(1262304000), first)
+				assert.Equal(t, int64(1893456000), last)
+				assert.NotEqual(t, oldFirst, first)
+				assert.NotEqual(t, oldLast, last)
+			}
+
+			ind, err := store.FindIndividual("old.reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, ind, 1) {
+				assert.Equal(t, "Q", ind[0].Which)
+				assert.Equal(t, uint(1), ind[0].Count)
+			}
+		})
+	}
+}
@@ -2,27 +2,104 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
 )
 
-func index(store Store, filenames []string) error {
-	var didWork bool
+//logSource is a log to be indexed. Files are opened by name, while a
+//source with a reader (like stdin) uses name only as the logical name
+//recorded in the filenames table. A reader with no name is indexed without
+//checking or recording whether it was already indexed. A source with a
+//format is an export in one of the importFormats instead of a dns log.
+type logSource struct {
+	name   string
+	reader io.Reader
+	format string
+}
+
+func (ls logSource) String() string {
+	if ls.name == "" {
+		return "<stdin>"
+	}
+	return ls.name
+}
+
+func (ls logSource) aggregate(aggregator *DNSAggregator) error {
+	if ls.format != "" {
+		if ls.reader == nil {
+			return importFile(aggregator, ls.name, ls.format)
+		}
+		return importReader(aggregator, ls.reader, ls.format, ls.String())
+	}
+	if ls.reader == nil {
+		return aggregate(aggregator, ls.name)
+	}
+	return aggregateReader(aggregator, ls.reader, ls.String())
+}
+
+func fileSources(filenames []string) []logSource {
+	var sources []logSource
+	for _, fn := range filenames {
+		sources = append(sources, logSource{name: fn})
+	}
+	return sources
+}
+
+//logSources turns the arguments of index and the commands like it into
+//sources, with - being stdin recorded as name
+func logSources(args []string, name string, format string) []logSource {
+	var sources []logSource
+	for _, fn := range args {
+		if fn == "-" {
+			sources = append(sources, logSource{name: name, reader: os.Stdin, format: format})
+		} else {
+			sources = append(sources, logSource{name: fn, format: format})
+		}
+	}
+	return sources
+}
+
+func index(store Store, sensor string, filenames []string) error {
+	return indexSources(store, sensor, fileSources(filenames))
+}
+
+//indexReader indexes a single log read from r, recording it as name
+func indexReader(store Store, sensor string, r io.Reader, name string) error {
+	return indexSources(store, sensor, []logSource{{name: name, reader: r}})
+}
+
+//indexSources indexes logs from sensor. Every sensor keeps track of the
+//logs it indexed separately, so two sensors can both have a dns.log.
+func indexSources(store Store, sensor string, sources []logSource) error {
 	store.Begin()
+	err := indexSourcesTx(store, sensor, sources)
+	if err != nil {
+		store.Rollback()
+	}
+	return err
+}
+
+func indexSourcesTx(store Store, sensor string, sources []logSource) error {
+	var didWork bool
 	aggregator := NewDNSAggregator()
 	var emptyStoreResult UpdateResult
 	aggMap := make(map[string]aggregationResult)
-	for _, fn := range filenames {
-		indexed, err := store.IsLogIndexed(fn)
-		if err != nil {
-			return fmt.Errorf("store.IsLogIndexed: %w", err)
-		}
-		if indexed {
-			log.Printf("%s: Already indexed", fn)
-			continue
+	for _, src := range sources {
+		fn := src.String()
+		if src.name != "" {
+			indexed, err := store.IsLogIndexed(sensor, src.name)
+			if err != nil {
+				return fmt.Errorf("store.IsLogIndexed: %w", err)
+			}
+			if indexed {
+				log.Printf("%s: Already indexed", fn)
+				continue
+			}
 		}
 
 		fileAgg := NewDNSAggregator()
-		err = aggregate(fileAgg, fn)
+		err := src.aggregate(fileAgg)
 		if err != nil {
 			return fmt.Errorf("Error Aggregating %s: %w", fn, err)
 		}
@@ -36,21 +113,24 @@ func index(store Store, filenames []string) error {
 			aggregated.TuplesLen,
 			aggregated.IndividualLen,
 		)
-		aggMap[fn] = aggregated.ShallowCopy()
+		if src.name != "" {
+			aggMap[src.name] = aggregated.ShallowCopy()
+		}
 		didWork = true
 	}
 	if !didWork {
-		return nil
-		//TODO: rollback transaction
+		//Nothing was written, but the transaction still needs to be closed
+		return store.Commit()
 	}
 	aggregated := aggregator.GetResult()
+	aggregated.Sensor = sensor
 	result, err := store.Update(aggregated)
 	if err != nil {
 		return fmt.Errorf("store.Update: %w", err)
 	}
 	log.Printf("batch: Store: Duration=%0.1f Inserted=%d Updated=%d", result.Duration.Seconds(), result.Inserted, result.Updated)
 	for fn, aggregated := range aggMap {
-		err = store.SetLogIndexed(fn, aggregated, emptyStoreResult)
+		err = store.SetLogIndexed(sensor, fn, aggregated, emptyStoreResult)
 		if err != nil {
 			return fmt.Errorf("store.SetLogIndexed: %w", err)
 		}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+//signalContext returns a context that is cancelled on SIGINT or SIGTERM,
+//for the long running commands to shut down cleanly
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
 func getStore() Store {
 	storeType := viper.GetString("store.type")
 	storeUri := viper.GetString("store.uri")
@@ -19,6 +31,43 @@ func getStore() Store {
 	return mystore
 }
 
+//showMore tells how to get the next page when a search was truncated
+func showMore(opts SearchOptions, truncated bool) {
+	if truncated {
+		log.Printf("There are more results, use --offset %d to see them", opts.Offset+opts.Limit)
+	}
+}
+
+//searchOptions reads the flags shared by the find and like commands
+func searchOptions(cmd *cobra.Command) SearchOptions {
+	var opts SearchOptions
+	opts.Sensor, _ = cmd.Flags().GetString("sensor")
+	opts.BySensor, _ = cmd.Flags().GetBool("by-sensor")
+	opts.RawPrefix, _ = cmd.Flags().GetBool("raw")
+	opts.Limit, _ = cmd.Flags().GetInt("limit")
+	opts.Offset, _ = cmd.Flags().GetInt("offset")
+	opts.Sort, _ = cmd.Flags().GetString("sort")
+	opts.RRTypes, _ = cmd.Flags().GetStringSlice("type")
+	now := time.Now()
+	for flag, t := range map[string]*time.Time{
+		"first-after":  &opts.FirstAfter,
+		"first-before": &opts.FirstBefore,
+		"last-after":   &opts.LastAfter,
+		"last-before":  &opts.LastBefore,
+	} {
+		value, _ := cmd.Flags().GetString(flag)
+		var err error
+		*t, err = parseFence(value, now)
+		if err != nil {
+			log.Fatalf("--%s: %v", flag, err)
+		}
+	}
+	if err := opts.check(); err != nil {
+		log.Fatal(err)
+	}
+	return opts
+}
+
 var RootCmd = &cobra.Command{
 	Use:   "zeek-pdns",
 	Short: "Passive DNS Collection for BRO",
@@ -26,11 +75,214 @@ var RootCmd = &cobra.Command{
 }
 
 var IndexCmd = &cobra.Command{
-	Use:   "index",
+	Use:   "index [file...|-]",
 	Short: "Index one or more dns log files",
+	Long: `Index one or more dns log files.
+
+Use - to read a log from stdin. Compression is detected automatically.
+--name sets the name stdin is recorded as so it is not indexed twice,
+and implies - when no files are given.
+
+With --follow a single live log, like current/dns.log, is tailed and
+flushed to the store periodically. Log rotation is detected and the
+position is saved to --state-file so a restart doesn't count records
+twice.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if viper.GetBool("index.follow") {
+			if len(args) != 1 {
+				log.Fatal("--follow requires exactly one log file")
+			}
+			mystore := getStore()
+			err := follow(mystore, viper.GetString("index.sensor"), args[0],
+				viper.GetString("index.state-file"),
+				viper.GetDuration("index.flush-interval"),
+				viper.GetUint("index.flush-records"))
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		name := viper.GetString("index.name")
+		if len(args) == 0 && name != "" {
+			args = []string{"-"}
+		}
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		mystore := getStore()
+		err := indexSources(mystore, viper.GetString("index.sensor"), logSources(args, name, ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var ImportCmd = &cobra.Command{
+	Use:   "import [file...|-]",
+	Short: "Import records from a passive DNS export",
+	Long: `Import the tuples in a passive DNS export into the store.
+
+--format is cof for the passive DNS Common Output Format, dnsdb for DNSDB
+API v1 or v2 output, or ndjson for the JSON tuples, individual values and
+rcodes zeek-pdns outputs. The counts of records that are already in the
+store are added up and their first and last times widened, just like when
+indexing logs. Individual values are worked out from the tuples unless the
+export has its own. Files are only imported once, like logs.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		format := viper.GetString("import.format")
+		if !validImportFormat(format) {
+			log.Fatalf("Unsupported format %q, use one of %s", format, strings.Join(importFormats, ", "))
+		}
+		name := viper.GetString("import.name")
+		if len(args) == 0 && name != "" {
+			args = []string{"-"}
+		}
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
 		mystore := getStore()
-		err := index(mystore, args)
+		err := indexSources(mystore, viper.GetString("import.sensor"), logSources(args, name, format))
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var AggregateCmd = &cobra.Command{
+	Use:   "aggregate [file...|-]",
+	Short: "Aggregate dns logs into a batch for ingest",
+	Long: `Aggregate one or more dns log files into a single gzip compressed batch,
+to be loaded on another host with ingest or sent with push.
+
+The batch has the tuples, individual values and rcodes of all the logs,
+and the name and statistics of each of them, so ingest can record them
+as indexed. --output is written to a temporary file first and renamed
+when it is complete.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := viper.GetString("aggregate.name")
+		if len(args) == 0 && name != "" {
+			args = []string{"-"}
+		}
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		hdr, aggregated, err := aggregateBatch(viper.GetString("aggregate.sensor"), logSources(args, name, ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		output := viper.GetString("aggregate.output")
+		if output == "-" {
+			err = writeBatch(os.Stdout, hdr, aggregated)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		tmp := output + ".tmp"
+		f, err := os.Create(tmp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writeBatch(f, hdr, aggregated)
+		if err == nil {
+			err = f.Close()
+		} else {
+			f.Close()
+		}
+		if err == nil {
+			err = os.Rename(tmp, output)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			log.Fatal(err)
+		}
+	},
+}
+
+var IngestCmd = &cobra.Command{
+	Use:   "ingest [file...|-]",
+	Short: "Load batches written by aggregate",
+	Long: `Load batches written by aggregate into the store.
+
+The logs in a batch are recorded as indexed for the sensor the batch came
+from, or --sensor, so loading a batch again does nothing.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		mystore := getStore()
+		sensor := viper.GetString("ingest.sensor")
+		for _, fn := range args {
+			var err error
+			if fn == "-" {
+				err = ingest(mystore, sensor, os.Stdin, "<stdin>")
+			} else {
+				err = ingestFile(mystore, sensor, fn)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	},
+}
+
+var PushCmd = &cobra.Command{
+	Use:   "push [file...|-]",
+	Short: "Aggregate dns logs and push them to a web server",
+	Long: `Aggregate one or more dns log files into a batch, like aggregate, and
+send it to a zeek-pdns web started with --push-token, for sensors that
+can't be reached from the database host.
+
+The server records the logs as indexed for --sensor, so pushing the same
+logs again does nothing.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		server := viper.GetString("push.server")
+		if server == "" {
+			log.Fatal("--server is required")
+		}
+		name := viper.GetString("push.name")
+		if len(args) == 0 && name != "" {
+			args = []string{"-"}
+		}
+		if len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+		hdr, aggregated, err := aggregateBatch(viper.GetString("push.sensor"), logSources(args, name, ""))
+		if err != nil {
+			log.Fatal(err)
+		}
+		res, err := pushBatch(server, viper.GetString("push.token"), hdr, aggregated)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if res.Loaded {
+			log.Printf("%s: Pushed %d logs", server, len(res.Files))
+		} else {
+			log.Printf("%s: Already indexed", server)
+		}
+	},
+}
+
+var WatchCmd = &cobra.Command{
+	Use:   "watch <dir>",
+	Short: "Index rotated dns logs as they show up in a log archive",
+	Long: `Scan a zeek log archive every --interval and index any rotated dns logs
+that haven't been indexed yet. Logs that fail to index are retried with
+an increasing delay. On SIGINT or SIGTERM the batch being indexed is
+committed before exiting.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		err := watch(mystore, viper.GetString("watch.sensor"), args[0],
+			viper.GetString("watch.pattern"),
+			viper.GetDuration("watch.interval"),
+			viper.GetDuration("watch.settle"),
+			viper.GetInt("watch.batch-size"))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -45,15 +297,24 @@ var FindCmd = &cobra.Command{
 var FindTupleCmd = &cobra.Command{
 	Use:   "tuples",
 	Short: "find dns tuples",
+	Long: `Find the tuples for a name or answer. A CIDR prefix like 10.1.0.0/16,
+or a range like 10.1.0.0-10.1.3.255, finds every tuple with an A or AAAA
+answer inside it.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		mystore := getStore()
+		opts := searchOptions(cmd)
 
 		for _, value := range args {
-			recs, err := mystore.FindTuples(value)
+			search := mystore.FindTuples
+			if isIPRange(value) {
+				search = mystore.CIDRTuples
+			}
+			recs, more, err := tuplePage(search, value, opts)
 			if err != nil {
 				log.Fatal(err)
 			}
 			recs.Display()
+			showMore(opts, more)
 		}
 	},
 }
@@ -63,33 +324,86 @@ var FindIndividualCmd = &cobra.Command{
 	Short: "find an individual dns value",
 	Run: func(cmd *cobra.Command, args []string) {
 		mystore := getStore()
+		opts := searchOptions(cmd)
 
 		for _, value := range args {
-			recs, err := mystore.FindIndividual(value)
+			recs, more, err := individualPage(mystore.FindIndividual, value, opts)
 			if err != nil {
 				log.Fatal(err)
 			}
 			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+var FindRcodesCmd = &cobra.Command{
+	Use:   "rcodes",
+	Short: "find the response codes seen for a query",
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		for _, value := range args {
+			recs, more, err := rcodePage(mystore.FindRcodes, value, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recs.Display()
+			showMore(opts, more)
 		}
 	},
 }
 var LikeCmd = &cobra.Command{
 	Use:   "like",
 	Short: "find records like something",
-	Run:   nil,
+	Long: `Find records for a name and every name below it. like tuples google.com
+matches google.com and www.google.com but not evilgoogle.com. Answers that
+are addresses match on whole octets. --raw matches any string prefix.
+
+tuples and individual also take shell style patterns, like
+'*.corp.example.com' or 'mail*.example.com'. Patterns are fastest when
+they start or end with literal text.`,
+	Run: nil,
 }
 var LikeTupleCmd = &cobra.Command{
 	Use:   "tuples",
 	Short: "find like dns tuples",
 	Run: func(cmd *cobra.Command, args []string) {
 		mystore := getStore()
+		opts := searchOptions(cmd)
 
 		for _, value := range args {
-			recs, err := mystore.LikeTuples(value)
+			search := mystore.LikeTuples
+			if isGlob(value) {
+				search = mystore.GlobTuples
+			}
+			recs, more, err := tuplePage(search, value, opts)
 			if err != nil {
 				log.Fatal(err)
 			}
 			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+
+var LikeAnswersCmd = &cobra.Command{
+	Use:   "answers",
+	Short: "find tuples whose answer is a name under a domain",
+	Long: `Find the tuples whose answer is a name under a domain, like every name
+that is a CNAME for something in cloudfront.net. Only answers that are
+names, like CNAME, NS or MX targets, are searched.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		for _, value := range args {
+			recs, more, err := tuplePage(mystore.LikeAnswers, value, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recs.Display()
+			showMore(opts, more)
 		}
 	},
 }
@@ -99,13 +413,148 @@ var LikeIndividualCmd = &cobra.Command{
 	Short: "find like individual dns values",
 	Run: func(cmd *cobra.Command, args []string) {
 		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		for _, value := range args {
+			search := mystore.LikeIndividual
+			if isGlob(value) {
+				search = mystore.GlobIndividual
+			}
+			recs, more, err := individualPage(search, value, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+
+var LikeRcodesCmd = &cobra.Command{
+	Use:   "rcodes",
+	Short: "find like response codes",
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		for _, value := range args {
+			recs, more, err := rcodePage(mystore.LikeRcodes, value, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+
+var ContainsCmd = &cobra.Command{
+	Use:   "contains",
+	Short: "find records containing a substring",
+	Long: `Find records with a name containing a substring anywhere, like every
+name with paypal in it. Without the substring-index these searches scan
+every record.`,
+	Run: nil,
+}
+var ContainsTupleCmd = &cobra.Command{
+	Use:   "tuples",
+	Short: "find dns tuples containing a substring",
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		for _, value := range args {
+			recs, more, err := tuplePage(mystore.ContainsTuples, value, opts)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+var ContainsIndividualCmd = &cobra.Command{
+	Use:   "individual",
+	Short: "find individual dns values containing a substring",
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		opts := searchOptions(cmd)
 
 		for _, value := range args {
-			recs, err := mystore.LikeIndividual(value)
+			recs, more, err := individualPage(mystore.ContainsIndividual, value, opts)
 			if err != nil {
 				log.Fatal(err)
 			}
 			recs.Display()
+			showMore(opts, more)
+		}
+	},
+}
+
+var ExportCmd = &cobra.Command{
+	Use:   "export [query...]",
+	Short: "export tuples in the passive DNS Common Output Format",
+	Long: `Export tuples as passive DNS Common Output Format (COF) records, one JSON
+object per line. Without a query the whole store is streamed, otherwise the
+tuples a like tuples search, or find tuples with --exact, would return.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		if format != "cof" {
+			log.Fatalf("Unsupported format %q, only cof is supported", format)
+		}
+		exact, _ := cmd.Flags().GetBool("exact")
+		mystore := getStore()
+		opts := searchOptions(cmd)
+
+		out := bufio.NewWriter(os.Stdout)
+		cw := newCOFWriter(out)
+		if len(args) == 0 {
+			err := mystore.ExportTuples(opts, cw.Write)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		for _, value := range args {
+			var recs tupleResults
+			var err error
+			if isIPRange(value) {
+				recs, err = mystore.CIDRTuples(value, opts)
+			} else if exact {
+				recs, err = mystore.FindTuples(value, opts)
+			} else if isGlob(value) {
+				recs, err = mystore.GlobTuples(value, opts)
+			} else {
+				recs, err = mystore.LikeTuples(value, opts)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, rec := range recs {
+				err = cw.Write(rec)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+		err := out.Flush()
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var SubstringIndexCmd = &cobra.Command{
+	Use:   "substring-index",
+	Short: "create the index used by contains searches",
+	Long: `Create the optional index used by contains searches. It is a trigram
+index in postgresql (pg_trgm), an FTS5 trigram table in sqlite and n-gram
+bloom filter skip indexes in clickhouse. Once created it is kept up to date
+as logs are indexed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		mystore := getStore()
+		err := mystore.InitSubstringIndex()
+		if err != nil {
+			log.Fatal(err)
 		}
 	},
 }
@@ -130,7 +579,11 @@ var WebCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		mystore := getStore()
 		bind := viper.GetString("http.listen")
-		startWeb(mystore, bind)
+		startWeb(mystore, bind, webConfig{
+			dnsdb:        viper.GetBool("http.dnsdb"),
+			pushToken:    viper.GetString("http.push-token"),
+			pushMaxBytes: viper.GetInt64("http.push-max-bytes"),
+		})
 	},
 }
 
@@ -143,15 +596,108 @@ var VersionCmd = &cobra.Command{
 }
 
 func init() {
+	IndexCmd.Flags().String("name", "", "Name to record a log read from stdin as")
+	viper.BindPFlag("index.name", IndexCmd.Flags().Lookup("name"))
+	IndexCmd.Flags().Bool("follow", false, "Continuously follow a live log file")
+	viper.BindPFlag("index.follow", IndexCmd.Flags().Lookup("follow"))
+	IndexCmd.Flags().String("state-file", "zeek-pdns-follow.json", "File to save the --follow position in")
+	viper.BindPFlag("index.state-file", IndexCmd.Flags().Lookup("state-file"))
+	viper.BindEnv("index.state-file", "PDNS_FOLLOW_STATE_FILE")
+	IndexCmd.Flags().Duration("flush-interval", 60*time.Second, "How often --follow flushes to the store")
+	viper.BindPFlag("index.flush-interval", IndexCmd.Flags().Lookup("flush-interval"))
+	IndexCmd.Flags().Uint("flush-records", 100000, "Number of records after which --follow flushes to the store")
+	viper.BindPFlag("index.flush-records", IndexCmd.Flags().Lookup("flush-records"))
+	IndexCmd.Flags().String("sensor", "", "Name of the sensor the logs came from")
+	viper.BindPFlag("index.sensor", IndexCmd.Flags().Lookup("sensor"))
+	viper.BindEnv("index.sensor", "PDNS_SENSOR")
 	RootCmd.AddCommand(IndexCmd)
 
+	ImportCmd.Flags().String("format", "cof", "Format of the export: cof, dnsdb or ndjson")
+	viper.BindPFlag("import.format", ImportCmd.Flags().Lookup("format"))
+	ImportCmd.Flags().String("name", "", "Name to record an export read from stdin as")
+	viper.BindPFlag("import.name", ImportCmd.Flags().Lookup("name"))
+	ImportCmd.Flags().String("sensor", "", "Name of the sensor to import the records as")
+	viper.BindPFlag("import.sensor", ImportCmd.Flags().Lookup("sensor"))
+	viper.BindEnv("import.sensor", "PDNS_SENSOR")
+	RootCmd.AddCommand(ImportCmd)
+
+	AggregateCmd.Flags().StringP("output", "o", "-", "File to write the batch to, - for stdout")
+	viper.BindPFlag("aggregate.output", AggregateCmd.Flags().Lookup("output"))
+	AggregateCmd.Flags().String("name", "", "Name to record a log read from stdin as")
+	viper.BindPFlag("aggregate.name", AggregateCmd.Flags().Lookup("name"))
+	AggregateCmd.Flags().String("sensor", "", "Name of the sensor the logs came from")
+	viper.BindPFlag("aggregate.sensor", AggregateCmd.Flags().Lookup("sensor"))
+	viper.BindEnv("aggregate.sensor", "PDNS_SENSOR")
+	RootCmd.AddCommand(AggregateCmd)
+
+	IngestCmd.Flags().String("sensor", "", "Load batches as this sensor instead of the one they came from")
+	viper.BindPFlag("ingest.sensor", IngestCmd.Flags().Lookup("sensor"))
+	RootCmd.AddCommand(IngestCmd)
+
+	PushCmd.Flags().String("server", "", "Base URL of the zeek-pdns web server, like https://pdns.example.com:8080")
+	viper.BindPFlag("push.server", PushCmd.Flags().Lookup("server"))
+	viper.BindEnv("push.server", "PDNS_PUSH_SERVER")
+	PushCmd.Flags().String("token", "", "Token the server was started with as --push-token")
+	viper.BindPFlag("push.token", PushCmd.Flags().Lookup("token"))
+	viper.BindEnv("push.token", "PDNS_PUSH_TOKEN")
+	PushCmd.Flags().String("name", "", "Name to record a log read from stdin as")
+	viper.BindPFlag("push.name", PushCmd.Flags().Lookup("name"))
+	PushCmd.Flags().String("sensor", "", "Name of the sensor the logs came from")
+	viper.BindPFlag("push.sensor", PushCmd.Flags().Lookup("sensor"))
+	viper.BindEnv("push.sensor", "PDNS_SENSOR")
+	RootCmd.AddCommand(PushCmd)
+
+	WatchCmd.Flags().String("pattern", "dns.*.log*", "Glob matching the base name of logs to index")
+	viper.BindPFlag("watch.pattern", WatchCmd.Flags().Lookup("pattern"))
+	WatchCmd.Flags().Duration("interval", 60*time.Second, "How often to scan for new logs")
+	viper.BindPFlag("watch.interval", WatchCmd.Flags().Lookup("interval"))
+	WatchCmd.Flags().Duration("settle", 30*time.Second, "Ignore logs modified more recently than this")
+	viper.BindPFlag("watch.settle", WatchCmd.Flags().Lookup("settle"))
+	WatchCmd.Flags().Int("batch-size", 50, "Number of logs to index in one transaction")
+	viper.BindPFlag("watch.batch-size", WatchCmd.Flags().Lookup("batch-size"))
+	WatchCmd.Flags().String("sensor", "", "Name of the sensor the logs came from")
+	viper.BindPFlag("watch.sensor", WatchCmd.Flags().Lookup("sensor"))
+	viper.BindEnv("watch.sensor", "PDNS_SENSOR")
+	RootCmd.AddCommand(WatchCmd)
+
+	for _, cmd := range []*cobra.Command{FindCmd, LikeCmd, ContainsCmd, ExportCmd} {
+		cmd.PersistentFlags().String("sensor", "", "Only show records from this sensor")
+		cmd.PersistentFlags().Bool("by-sensor", false, "Show a row per sensor instead of merging them")
+		cmd.PersistentFlags().String("first-after", "", "Only show records first seen after this time")
+		cmd.PersistentFlags().String("first-before", "", "Only show records first seen before this time")
+		cmd.PersistentFlags().String("last-after", "", "Only show records last seen after this time")
+		cmd.PersistentFlags().String("last-before", "", "Only show records last seen before this time")
+		cmd.PersistentFlags().Int("limit", 0, "Maximum number of records to show, 0 for all of them")
+		cmd.PersistentFlags().Int("offset", 0, "Number of records to skip, with --limit")
+		cmd.PersistentFlags().String("sort", "name", "Sort by name, count, first or last, prefix with - to reverse")
+	}
+
+	LikeCmd.PersistentFlags().Bool("raw", false, "Match any string prefix instead of whole labels")
+
+	for _, cmd := range []*cobra.Command{FindTupleCmd, LikeTupleCmd, LikeAnswersCmd, ContainsTupleCmd, ExportCmd} {
+		cmd.Flags().StringSlice("type", nil, "Only show answers of these types, like MX or A,AAAA")
+	}
+
 	RootCmd.AddCommand(FindCmd)
 	FindCmd.AddCommand(FindIndividualCmd)
 	FindCmd.AddCommand(FindTupleCmd)
+	FindCmd.AddCommand(FindRcodesCmd)
 
 	RootCmd.AddCommand(LikeCmd)
 	LikeCmd.AddCommand(LikeIndividualCmd)
 	LikeCmd.AddCommand(LikeTupleCmd)
+	LikeCmd.AddCommand(LikeAnswersCmd)
+	LikeCmd.AddCommand(LikeRcodesCmd)
+
+	RootCmd.AddCommand(ContainsCmd)
+	ContainsCmd.AddCommand(ContainsIndividualCmd)
+	ContainsCmd.AddCommand(ContainsTupleCmd)
+	RootCmd.AddCommand(SubstringIndexCmd)
+
+	ExportCmd.Flags().String("format", "cof", "Output format, only cof is supported")
+	ExportCmd.Flags().Bool("exact", false, "Export what find tuples would return instead of like tuples")
+	ExportCmd.Flags().Bool("raw", false, "Match any string prefix instead of whole labels")
+	RootCmd.AddCommand(ExportCmd)
 
 	DeleteOldCmd.Flags().Int64("days", 365, "Age in days of records to be deleted")
 	viper.BindPFlag("deleteold.days", DeleteOldCmd.Flags().Lookup("days"))
@@ -161,6 +707,15 @@ func init() {
 	WebCmd.Flags().String("listen", ":8080", "Address to listen on")
 	viper.BindPFlag("http.listen", WebCmd.Flags().Lookup("listen"))
 	viper.BindEnv("http.listen", "PDNS_HTTP_LISTEN")
+	WebCmd.Flags().Bool("dnsdb", false, "Also serve the DNSDB API v2 compatible routes under /dnsdb/v2")
+	viper.BindPFlag("http.dnsdb", WebCmd.Flags().Lookup("dnsdb"))
+	viper.BindEnv("http.dnsdb", "PDNS_HTTP_DNSDB")
+	WebCmd.Flags().String("push-token", "", "Accept batches from push authenticated with this token")
+	viper.BindPFlag("http.push-token", WebCmd.Flags().Lookup("push-token"))
+	viper.BindEnv("http.push-token", "PDNS_HTTP_PUSH_TOKEN")
+	WebCmd.Flags().Int64("push-max-bytes", defaultPushMaxBytes, "Largest batch push accepts, compressed or not")
+	viper.BindPFlag("http.push-max-bytes", WebCmd.Flags().Lookup("push-max-bytes"))
+	viper.BindEnv("http.push-max-bytes", "PDNS_HTTP_PUSH_MAX_BYTES")
 
 	RootCmd.AddCommand(WebCmd)
 	RootCmd.AddCommand(VersionCmd)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+//idnaProfile converts internationalized names to their A-label (punycode)
+//form. Names in dns logs are often not valid hostnames, like _dmarc
+//records, so only the mapping is strict, not the allowed characters.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+	idna.Transitional(false),
+)
+
+//normalizeName returns the form names are stored and searched in: lower
+//case, without the trailing root dot and with IDNs as A-labels. Names that
+//can't be converted are only lower cased.
+func normalizeName(name string) string {
+	plain := true
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 0x80 || ('A' <= c && c <= 'Z') {
+			plain = false
+			break
+		}
+	}
+	if len(name) > 1 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	if plain {
+		return name
+	}
+	name = strings.ToLower(name)
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 0x80 {
+			if ascii, err := idnaProfile.ToASCII(name); err == nil {
+				return ascii
+			}
+			break
+		}
+	}
+	return name
+}
+
+//isNameType is true for answer types whose value is a name, and so should
+//be normalized. Anything else, like TXT, is kept as it was logged.
+func isNameType(rrtype string) bool {
+	switch rrtype {
+	case "CNAME", "DNAME", "NS", "PTR", "MX", "SRV":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"WWW.Example.COM", "www.example.com"},
+		{"www.example.com.", "www.example.com"},
+		{".", "."},
+		{"", ""},
+		{"_dmarc.Example.com", "_dmarc.example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"Bücher.Example.", "xn--bcher-kva.example"},
+		{"XN--BCHER-KVA.example", "xn--bcher-kva.example"},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, normalizeName(tt.name), tt.name)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//pushPath is where web accepts batches from push
+const pushPath = "/push"
+
+//defaultPushMaxBytes is the largest batch push accepts, both compressed
+//and after decompressing it, unless web is told otherwise. Batches are
+//aggregated, so even a busy sensor's day of logs is far smaller.
+const defaultPushMaxBytes int64 = 256 << 20
+
+//pushResponse is what web answers a push with
+type pushResponse struct {
+	Loaded bool     `json:"loaded"`
+	Files  []string `json:"files"`
+}
+
+func (h *pdnsHandler) pushAuthorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.pushToken)) == 1
+}
+
+//handlePush loads a batch written by writeBatch. The store only has one
+//transaction at a time, so batches are loaded one after the other. They
+//are also read one at a time, so only one is ever held in memory.
+func (h *pdnsHandler) handlePush(w http.ResponseWriter, req *http.Request) {
+	if !h.pushAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="zeek-pdns"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := "push from " + req.RemoteAddr
+	h.pushLock.Lock()
+	defer h.pushLock.Unlock()
+	hdr, aggregated, err := readBatch(req.Body, name, h.pushMaxBytes)
+	if errors.Is(err, errBatchTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	loaded, err := loadBatch(h.s, "", hdr, aggregated, name)
+	if errors.Is(err, errPartiallyIndexed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("%s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := pushResponse{Loaded: loaded, Files: []string{}}
+	for _, f := range hdr.Files {
+		res.Files = append(res.Files, f.Name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+//pushBatch sends a batch to the web command running on server, which is
+//its base URL like https://pdns.example.com:8080
+func pushBatch(server string, token string, hdr batchHeader, aggregated aggregationResult) (pushResponse, error) {
+	var res pushResponse
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBatch(pw, hdr, aggregated))
+	}()
+	defer pr.Close()
+
+	req, err := http.NewRequest("POST", strings.TrimRight(server, "/")+pushPath, pr)
+	if err != nil {
+		return res, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return res, fmt.Errorf("push to %s failed: %s: %s", server, resp.Status, strings.TrimSpace(string(body)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
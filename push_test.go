@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPush(t *testing.T) {
+	ts := testStores[0]
+	store, err := NewStore(ts.storetype, ts.uri)
+	if err != nil {
+		t.Fatalf("can't create store at %s: %v", ts.uri, err)
+	}
+	store.Clear()
+	store.Init()
+	srv := httptest.NewServer(newRouter(store, webConfig{pushToken: "s3cret"}))
+	defer srv.Close()
+
+	hdr, aggregated, err := aggregateBatch("edge", fileSources([]string{"test_data/reddit_1.txt"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pushBatch(srv.URL, "wrong", hdr, aggregated)
+	assert.Error(t, err)
+
+	res, err := pushBatch(srv.URL+"/", "s3cret", hdr, aggregated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, res.Loaded)
+	assert.Equal(t, []string{"test_data/reddit_1.txt"}, res.Files)
+	indexed, err := store.IsLogIndexed("edge", "test_data/reddit_1.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, indexed)
+
+	//Pushing the same logs again doesn't count them twice
+	res, err = pushBatch(srv.URL, "s3cret", hdr, aggregated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, res.Loaded)
+	recs, err := store.FindTuples("www.reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotEmpty(t, recs) {
+		assert.Equal(t, uint(1), recs[0].Count)
+	}
+
+	//Batches that overlap one that was loaded are refused, and anything
+	//that isn't a batch is a bad request
+	both, aggregated, err := aggregateBatch("edge", fileSources([]string{"test_data/reddit_1.txt", "test_data/reddit_2.txt"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pushBatch(srv.URL, "s3cret", both, aggregated)
+	assert.Error(t, err)
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", srv.URL+pushPath, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, post(`{"query":"example.com"}`))
+
+	//Batches are read one at a time, a second one waits for the first
+	small := httptest.NewServer(newRouter(store, webConfig{pushToken: "s3cret", pushMaxBytes: 10}))
+	defer small.Close()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	first := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", small.URL+pushPath, pr)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	pw.Write([]byte("{"))
+	second := make(chan int, 1)
+	go func() {
+		req, _ := http.NewRequest("POST", small.URL+pushPath, bytes.NewBufferString(`{"format":"zeek-pdns-aggregate","version":1,"files":[]}`))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			second <- 0
+			return
+		}
+		resp.Body.Close()
+		second <- resp.StatusCode
+	}()
+	select {
+	case <-second:
+		t.Fatal("second push was read while the first one was")
+	case <-time.After(100 * time.Millisecond):
+	}
+	pw.Close()
+	assert.Equal(t, http.StatusBadRequest, <-first)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, <-second)
+
+	//Without a token there is nothing to push to
+	srv2 := httptest.NewServer(newRouter(store, webConfig{}))
+	defer srv2.Close()
+	_, err = pushBatch(srv2.URL, "", hdr, aggregated)
+	assert.Error(t, err)
+}
@@ -2,8 +2,19 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	opendecompress "github.com/JustinAzoff/go-opendecompress"
+	gzip "github.com/klauspost/pgzip"
 )
 
 type Reader interface {
@@ -13,13 +24,128 @@ type Reader interface {
 type Record interface {
 	String() string
 	GetString(string) string
-	GetTimestamp(string) string
+	LookupString(string) (string, bool)
+	GetTimestamp(string) time.Time
 	GetStringList(string) []string
 	GetFloat(string) float64
+	HasField(string) bool
 	Error() error
 	IsMissingFieldError() bool
 }
 
+var errInvalidTimestamp = errors.New("invalid timestamp")
+
+//isoTimestampFormats are the layouts tried for non epoch timestamps. zeek
+//writes UTC with a Z suffix, but logs that went through other tools may
+//have an explicit offset, with or without the colon.
+var isoTimestampFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+//parseEpoch parses seconds since the epoch without going through a float64
+//so the microseconds zeek logs survive intact. Both parts have to be plain
+//digits, ParseInt would also take signs.
+func parseEpoch(t string) (time.Time, error) {
+	secs, frac := t, ""
+	if idx := strings.IndexByte(t, '.'); idx != -1 {
+		secs, frac = t[:idx], t[idx+1:]
+		if !isDigits(frac) {
+			return time.Time{}, errInvalidTimestamp
+		}
+	}
+	if !isDigits(secs) {
+		return time.Time{}, errInvalidTimestamp
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if sec <= 0 {
+		return time.Time{}, errInvalidTimestamp
+	}
+	var nsec int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsec, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//parseTimestamp parses any of the timestamp encodings zeek uses: epoch
+//seconds with an optional fraction or ISO8601. The result is always in UTC.
+func parseTimestamp(t string) (time.Time, error) {
+	if ts, err := parseEpoch(t); err == nil {
+		return ts, nil
+	}
+	for _, layout := range isoTimestampFormats {
+		if ts, err := time.Parse(layout, t); err == nil {
+			return ts.UTC(), nil
+		}
+	}
+	//Last resort for things like 1.459468983e+09. Everything else
+	//ParseFloat accepts was already rejected by parseEpoch, and NaN, Inf
+	//and anything that doesn't fit in an int64 of seconds would overflow.
+	if !strings.ContainsAny(t, "eE") {
+		return time.Time{}, fmt.Errorf("%w: %q", errInvalidTimestamp, t)
+	}
+	if fl, err := strconv.ParseFloat(t, 64); err == nil && validEpochFloat(fl) {
+		sec := int64(fl)
+		return time.Unix(sec, int64((fl-float64(sec))*1e9)).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: %q", errInvalidTimestamp, t)
+}
+
+func validEpochFloat(fl float64) bool {
+	return !math.IsNaN(fl) && !math.IsInf(fl, 0) && fl >= 1 && fl < math.MaxInt64
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+//decompressReader sniffs the first few bytes of r and wraps it with the
+//same decompressors opendecompress uses for .gz, .bz2 and .xz files.
+//Anything else is assumed to be uncompressed.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return opendecompress.NewPipedDecompressor(ioutil.NopCloser(br), "xzcat")
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
 func NewBroReader(r io.Reader) (Reader, error) {
 	wrapped := bufio.NewReader(r)
 	first_byte, err := wrapped.Peek(1)
@@ -3,13 +3,25 @@ package main
 import (
 	"bufio"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	defaultSeparator      = "\t"
+	defaultSetSeparator   = ","
+	defaultEmptyField     = "(empty)"
+	defaultUnsetField     = "-"
+	headerSeparatorPrefix = "#separator"
+)
+
+var errUnsetField = errors.New("unset field")
+
 func grab_value(line string) string {
 	val := strings.Split(line, " ")[1]
 	return val
@@ -24,10 +36,34 @@ func extract_sep(line string) string {
 	return string(sepchar)
 }
 
+//unescape decodes the \xNN escape sequences zeek uses in ascii logs for
+//non-printable bytes and for values that contain a separator
+func unescape(val string) string {
+	if !strings.Contains(val, "\\x") {
+		return val
+	}
+	var sb strings.Builder
+	sb.Grow(len(val))
+	for i := 0; i < len(val); i++ {
+		if val[i] == '\\' && i+3 < len(val) && val[i+1] == 'x' {
+			if b, err := hex.DecodeString(val[i+2 : i+4]); err == nil {
+				sb.WriteByte(b[0])
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(val[i])
+	}
+	return sb.String()
+}
+
 type BroAsciiReader struct {
 	r          io.Reader
 	br         *bufio.Reader
 	sep        string
+	setSep     string
+	emptyField string
+	unsetField string
 	fields     []string
 	fieldsMap  map[string]int
 	types      []string
@@ -40,6 +76,7 @@ type ASCIIRecord struct {
 	line   *string
 	cols   *[]string
 	fields *map[string]int
+	reader *BroAsciiReader
 	err    error
 }
 
@@ -47,32 +84,103 @@ func (r *ASCIIRecord) String() string {
 	return *r.line
 }
 
-func (r *ASCIIRecord) GetString(field string) string {
+//getRaw returns the column for field exactly as it appeared in the log
+func (r *ASCIIRecord) getRaw(field string) (string, bool) {
 	idx, ok := (*r.fields)[field]
 	if !ok {
 		r.err = fmt.Errorf("Invalid field %s", field)
+		return "", false
+	}
+	if idx >= len(*r.cols) {
+		r.err = fmt.Errorf("Missing column %d for field %s", idx, field)
+		return "", false
+	}
+	return (*r.cols)[idx], true
+}
+
+//GetString returns the unset field marker as is, like it always has, so
+//records with an unset query or qtype_name are still aggregated
+func (r *ASCIIRecord) GetString(field string) string {
+	val, ok := r.getRaw(field)
+	if !ok {
 		return ""
 	}
-	return (*r.cols)[idx]
+	if val == r.reader.unsetField {
+		return val
+	}
+	if val == r.reader.emptyField {
+		return ""
+	}
+	return unescape(val)
 }
-func (r *ASCIIRecord) GetTimestamp(field string) string {
+
+//getRequired is GetString for fields that can't be used unset, like the
+//timestamp. The record fails with errUnsetField when they are.
+func (r *ASCIIRecord) getRequired(field string) string {
+	val, ok := r.getRaw(field)
+	if !ok {
+		return ""
+	}
+	if val == r.reader.unsetField {
+		r.err = fmt.Errorf("%s: %w", field, errUnsetField)
+		return ""
+	}
 	return r.GetString(field)
 }
+
+//LookupString is GetString for fields that are allowed to be unset, like
+//rcode_name when there was no response. It never sets an error.
+func (r *ASCIIRecord) LookupString(field string) (string, bool) {
+	idx, ok := (*r.fields)[field]
+	if !ok || idx >= len(*r.cols) {
+		return "", false
+	}
+	val := (*r.cols)[idx]
+	if val == r.reader.unsetField {
+		return "", false
+	}
+	if val == r.reader.emptyField {
+		return "", true
+	}
+	return unescape(val), true
+}
+func (r *ASCIIRecord) GetTimestamp(field string) time.Time {
+	val := r.getRequired(field)
+	if r.err != nil {
+		return time.Time{}
+	}
+	ts, err := parseTimestamp(val)
+	if err != nil {
+		r.err = err
+	}
+	return ts
+}
+
+//GetStringList splits a container field on the set separator. Both the
+//empty and the unset field markers result in an empty list, the same as a
+//missing or empty array in the JSON logs.
 func (r *ASCIIRecord) GetStringList(field string) []string {
-	raw := r.GetString(field)
-	spl := strings.Split(raw, ",")
+	raw, ok := r.getRaw(field)
+	if !ok {
+		return nil
+	}
+	if raw == r.reader.unsetField || raw == r.reader.emptyField {
+		return nil
+	}
+	spl := strings.Split(raw, r.reader.setSep)
+	for idx, val := range spl {
+		spl[idx] = unescape(val)
+	}
 	return spl
 }
 func (r *ASCIIRecord) GetStringByIndex(index int) string {
 	return (*r.cols)[index]
 }
 func (r *ASCIIRecord) GetFloat(field string) float64 {
-	idx, ok := (*r.fields)[field]
-	if !ok {
-		r.err = fmt.Errorf("Invalid field %s", field)
+	val := r.getRequired(field)
+	if r.err != nil {
 		return 0.0
 	}
-	val := (*r.cols)[idx]
 	fl, err := strconv.ParseFloat(val, 64)
 	if err != nil {
 		panic(err)
@@ -88,8 +196,7 @@ func (r *ASCIIRecord) GetFloatByIndex(index int) float64 {
 	return fl
 }
 func (r *ASCIIRecord) IsMissingFieldError() bool {
-	//TODO: handle here or jsut skip in Next?
-	return false
+	return errors.Is(r.err, errUnsetField)
 }
 func (r *ASCIIRecord) Error() error {
 	if r.err != nil {
@@ -98,6 +205,13 @@ func (r *ASCIIRecord) Error() error {
 	return nil
 }
 
+//HasField returns true if field is present in the log, for optional fields
+//added by scripts like dns-ans-query.bro
+func (r *ASCIIRecord) HasField(field string) bool {
+	_, ok := (*r.fields)[field]
+	return ok
+}
+
 func (r *ASCIIRecord) GetFieldIndex(field string) int {
 	idx, ok := (*r.fields)[field]
 	if ok {
@@ -109,8 +223,22 @@ func (r *ASCIIRecord) GetFieldIndex(field string) int {
 
 func NewBroAsciiReader(r io.Reader) *BroAsciiReader {
 	br := bufio.NewReader(r)
-	tf := make(map[int]bool)
-	return &BroAsciiReader{r: r, br: br, timeFields: tf}
+	b := &BroAsciiReader{r: r, br: br}
+	b.resetHeaders()
+	return b
+}
+
+//resetHeaders puts the reader back into the state it is in before any
+//header has been seen, using the zeek defaults for all of the directives
+func (b *BroAsciiReader) resetHeaders() {
+	b.sep = defaultSeparator
+	b.setSep = defaultSetSeparator
+	b.emptyField = defaultEmptyField
+	b.unsetField = defaultUnsetField
+	b.fields = nil
+	b.fieldsMap = make(map[string]int)
+	b.types = nil
+	b.timeFields = make(map[int]bool)
 }
 
 func (b *BroAsciiReader) Next() (Record, error) {
@@ -126,27 +254,48 @@ func (b *BroAsciiReader) Next() (Record, error) {
 		b.handleHeader(line)
 		return b.Next()
 	}
-	parts := strings.Split(line, "\t")
+	parts := strings.Split(line, b.sep)
 	rec := ASCIIRecord{
 		line:   &line,
 		cols:   &parts,
 		fields: &b.fieldsMap,
+		reader: b,
 	}
 	return &rec, nil
 }
 
+//headerValue returns the value of a header directive like #set_separator.
+//Everything but #separator itself is split using the current separator.
+func (b *BroAsciiReader) headerValue(line string) string {
+	parts := strings.SplitN(line, b.sep, 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return unescape(parts[1])
+}
+
 func (b *BroAsciiReader) handleHeader(line string) error {
 	b.newHeaders = true
-	if strings.HasPrefix(line, "#separator") {
+	if strings.HasPrefix(line, headerSeparatorPrefix) {
+		// #separator always starts a new header block, so anything learned
+		// from a previous block in a concatenated log no longer applies
+		b.resetHeaders()
 		b.sep = extract_sep(line)
+	} else if strings.HasPrefix(line, "#set_separator") {
+		b.setSep = b.headerValue(line)
+	} else if strings.HasPrefix(line, "#empty_field") {
+		b.emptyField = b.headerValue(line)
+	} else if strings.HasPrefix(line, "#unset_field") {
+		b.unsetField = b.headerValue(line)
 	} else if strings.HasPrefix(line, "#fields") {
-		b.fields = strings.Split(line, "\t")[1:]
+		b.fields = strings.Split(line, b.sep)[1:]
 		b.fieldsMap = make(map[string]int)
 		for idx, f := range b.fields {
 			b.fieldsMap[f] = idx
 		}
 	} else if strings.HasPrefix(line, "#types") {
-		b.types = strings.Split(line, "\t")[1:]
+		b.types = strings.Split(line, b.sep)[1:]
+		b.timeFields = make(map[int]bool)
 		for idx, typ := range b.types {
 			if typ == "time" {
 				b.timeFields[idx] = true
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/buger/jsonparser"
 )
@@ -22,25 +23,55 @@ func (r *JSONRecord) String() string {
 	return strings.Trim(string(r.line), "\n")
 }
 
+//setErr records the first error hit while reading fields, so a later
+//successful lookup doesn't hide it
+func (r *JSONRecord) setErr(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
 func (r *JSONRecord) GetString(field string) string {
 	val, err := jsonparser.GetString(r.line, field)
-	r.err = err
+	r.setErr(err)
 	return val
 }
+
+//LookupString is GetString for fields that are allowed to be missing. It
+//never sets an error.
+func (r *JSONRecord) LookupString(field string) (string, bool) {
+	val, err := jsonparser.GetString(r.line, field)
+	return val, err == nil
+}
 func (r *JSONRecord) GetStringList(field string) []string {
 	var strings []string
 	jsonparser.ArrayEach(r.line, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
-		strings = append(strings, string(value))
-		r.err = err
+		if err == nil && dataType == jsonparser.String {
+			// ArrayEach hands back the raw bytes, so escapes like \u0001
+			// still need to be decoded to match GetString
+			var s string
+			s, err = jsonparser.ParseString(value)
+			strings = append(strings, s)
+		} else {
+			strings = append(strings, string(value))
+		}
+		r.setErr(err)
 	}, field)
 	return strings
 }
 func (r *JSONRecord) GetFloat(field string) float64 {
 	val, err := jsonparser.GetFloat(r.line, field)
-	r.err = err
+	r.setErr(err)
 	return val
 }
 
+//HasField returns true if field is present in the record. Unset fields are
+//left out of json logs entirely.
+func (r *JSONRecord) HasField(field string) bool {
+	_, _, _, err := jsonparser.Get(r.line, field)
+	return err == nil
+}
+
 func (r *JSONRecord) IsMissingFieldError() bool {
 	return r.err == jsonparser.KeyPathNotFoundError
 }
@@ -70,17 +101,25 @@ func (b *BroJSONReader) Next() (Record, error) {
 	return &rec, nil
 }
 
-//GetTimestamp tries to get a field that may be a String or a float64
-//Yes, this is terrible, but supporting both timestamps and iso8601 at the same
-//time is tricky
-//TODO: use a struct type that is a string or float and can be lazy evaluated
-//for sorting and for final representation when being upserted
-func (r *JSONRecord) GetTimestamp(field string) string {
-	val, err := jsonparser.GetString(r.line, field)
-	if err == nil {
-		return val
+//GetTimestamp gets a field that may be an ISO8601 string or an epoch float.
+//The raw number is parsed rather than the float64 so no precision is lost.
+func (r *JSONRecord) GetTimestamp(field string) time.Time {
+	val, dataType, _, err := jsonparser.Get(r.line, field)
+	if err != nil {
+		r.setErr(err)
+		return time.Time{}
+	}
+	raw := string(val)
+	if dataType == jsonparser.String {
+		raw, err = jsonparser.ParseString(val)
+		if err != nil {
+			r.setErr(err)
+			return time.Time{}
+		}
+	}
+	ts, err := parseTimestamp(raw)
+	if err != nil {
+		r.setErr(err)
 	}
-	fval, err := jsonparser.GetFloat(r.line, field)
-	r.err = err
-	return fmt.Sprintf("%f", fval)
+	return ts
 }
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"errors"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func BenchmarkReadASCII(b *testing.B) {
@@ -18,3 +24,165 @@ func BenchmarkReadJSON(b *testing.B) {
 		aggregate(aggregator, fn)
 	}
 }
+
+func TestReadASCIIHeaderDirectives(t *testing.T) {
+	aggregator := NewDNSAggregator()
+	err := aggregate(aggregator, "test_data/custom_separator.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := aggregator.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+	sort.Sort(ByValue(res.Individual))
+
+	// The unset answers in the first block and the empty ones in both
+	// blocks should not show up as answers
+	assert.EqualValues(t, 6, res.TotalRecords)
+	assert.EqualValues(t, 0, res.SkippedRecords)
+	if assert.Len(t, res.Tuples, 2) {
+		assert.Equal(t, uniqueTuple{query: "www.example.com", answer: "1.2.3.4", qtype: "A", rrtype: "A"}, res.Tuples[0].uniqueTuple)
+		assert.EqualValues(t, 2, res.Tuples[0].count)
+		assert.Equal(t, uniqueTuple{query: "www.example.com", answer: "1.2.3.5", qtype: "A", rrtype: "A"}, res.Tuples[1].uniqueTuple)
+		assert.EqualValues(t, 1, res.Tuples[1].count)
+	}
+	var values []string
+	for _, v := range res.Individual {
+		values = append(values, v.which+" "+v.value)
+	}
+	assert.Equal(t, []string{
+		"A 1.2.3.4",
+		"A 1.2.3.5",
+		"Q mail.example.com",
+		"Q nx.example.com",
+		"Q timeout.example.com",
+		"Q www.example.com",
+	}, values)
+
+	// The unset rcode of the query that timed out is left out
+	var rcodes []string
+	for _, r := range res.Rcodes {
+		rcodes = append(rcodes, r.query+" "+r.qtype+" "+r.rcode)
+	}
+	sort.Strings(rcodes)
+	assert.Equal(t, []string{
+		"mail.example.com A NOERROR",
+		"nx.example.com A NXDOMAIN",
+		"www.example.com A NOERROR",
+		"www.example.com AAAA NOERROR",
+	}, rcodes)
+}
+
+func TestReadASCIIUnset(t *testing.T) {
+	header := "#separator \\x09\n#fields\tts\tquery\tqtype_name\trcode_name\tanswers\tTTLs\n"
+	log := header +
+		"1459468983.743478\t-\tA\tNOERROR\t1.2.3.4\t300.000000\n" +
+		"1459468984.743478\twww.example.com\t-\tNOERROR\t1.2.3.5\t300.000000\n" +
+		"-\twww.example.com\tA\tNOERROR\t1.2.3.6\t300.000000\n"
+	aggregator := NewDNSAggregator()
+	err := aggregateReader(aggregator, strings.NewReader(log), "unset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := aggregator.GetResult()
+	sort.Sort(ByTuple(res.Tuples))
+
+	// An unset query or qtype_name is kept as "-" like it always was, only
+	// a record without a timestamp can't be used
+	assert.EqualValues(t, 2, res.TotalRecords)
+	assert.EqualValues(t, 1, res.SkippedRecords)
+	if assert.Len(t, res.Tuples, 2) {
+		assert.Equal(t, uniqueTuple{query: "-", answer: "1.2.3.4", qtype: "A", rrtype: "A"}, res.Tuples[0].uniqueTuple)
+		assert.Equal(t, uniqueTuple{query: "www.example.com", answer: "1.2.3.5", qtype: "-", rrtype: "A"}, res.Tuples[1].uniqueTuple)
+	}
+}
+
+func TestReadASCIIUnescape(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"www.example.com", "www.example.com"},
+		{"tab\\x09here", "tab\there"},
+		{"a\\x2cb", "a,b"},
+		{"\\x00\\x00", "\x00\x00"},
+		{"odd\\text", "odd\\text"},
+		{"bad\\xzz", "bad\\xzz"},
+		{"short\\x4", "short\\x4"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.out, unescape(tt.in), "unescape(%q)", tt.in)
+	}
+}
+
+func TestReadASCIIAndJSONMatch(t *testing.T) {
+	load := func(fn string) aggregationResult {
+		aggregator := NewDNSAggregator()
+		err := aggregate(aggregator, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := aggregator.GetResult()
+		sort.Sort(ByTuple(res.Tuples))
+		sort.Sort(ByValue(res.Individual))
+		return res
+	}
+	ascii := load("test_data/escaped.log")
+	json := load("test_data/escaped.json")
+
+	assert.Equal(t, json.TotalRecords, ascii.TotalRecords)
+	assert.Equal(t, json.SkippedRecords, ascii.SkippedRecords)
+	assert.Equal(t, json.Tuples, ascii.Tuples)
+	assert.Equal(t, json.Individual, ascii.Individual)
+	assert.Len(t, ascii.Tuples, 6)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2019, 8, 27, 21, 0, 0, 58798000, time.UTC)
+	tests := []string{
+		"1566939600.058798",
+		"1566939600.058798000",
+		"2019-08-27T21:00:00.058798Z",
+		"2019-08-27T23:00:00.058798+02:00",
+		"2019-08-27T16:00:00.058798-0500",
+		"2019-08-27 21:00:00.058798",
+	}
+	for _, in := range tests {
+		ts, err := parseTimestamp(in)
+		if assert.NoError(t, err, in) {
+			assert.True(t, expected.Equal(ts), "parseTimestamp(%q) = %v, want %v", in, ts, expected)
+			assert.Equal(t, time.UTC, ts.Location())
+		}
+	}
+
+	ts, err := parseTimestamp("1566939600")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1566939600), ts.Unix())
+
+	ts, err = parseTimestamp("1.5669396e+09")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1566939600), ts.Unix())
+
+	for _, in := range []string{"", "yesterday", "2019-08-27", "12.34.56", "NaN", "Inf", "-Inf", "1e400", "1e300", "-1.5e+09", "0e0",
+		"0", "-5", "-1.5", "+5", "1.-5", "1.+5", "1.", ".5", "0.5", "5e-1"} {
+		_, err := parseTimestamp(in)
+		assert.True(t, errors.Is(err, errInvalidTimestamp), "parseTimestamp(%q) err = %v", in, err)
+	}
+}
+
+func TestReadBadTimestamp(t *testing.T) {
+	aggregator := NewDNSAggregator()
+	err := aggregate(aggregator, "test_data/bad_ts.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := aggregator.GetResult()
+	assert.EqualValues(t, 2, res.TotalRecords)
+	assert.EqualValues(t, 1, res.SkippedRecords)
+	sort.Sort(ByValue(res.Individual))
+	if assert.Len(t, res.Individual, 3) {
+		q := res.Individual[2]
+		assert.Equal(t, "googlemail.l.google.com", q.value)
+		assert.Equal(t, time.Date(2019, 8, 27, 21, 0, 0, 58798000, time.UTC), q.first)
+		assert.Equal(t, time.Date(2019, 8, 27, 21, 0, 0, 123456000, time.UTC), q.last)
+	}
+}
@@ -5,34 +5,141 @@ import (
 	"fmt"
 	"strings"
 	"time"
-	"log"
 )
 
 type Store interface {
 	Init() error
+	InitSubstringIndex() error
 	Clear() error
 	Begin() error
 	Commit() error
-	IsLogIndexed(filename string) (bool, error)
-	SetLogIndexed(filename string, ar aggregationResult, ur UpdateResult) error
+	Rollback() error
+	IsLogIndexed(sensor string, filename string) (bool, error)
+	SetLogIndexed(sensor string, filename string, ar aggregationResult, ur UpdateResult) error
 	Update(aggregationResult) (UpdateResult, error)
-	FindQueryTuples(query string) (tupleResults, error)
-	FindTuples(query string) (tupleResults, error)
-	FindIndividual(value string) (individualResults, error)
-	LikeTuples(query string) (tupleResults, error)
-	LikeIndividual(value string) (individualResults, error)
+	FindQueryTuples(query string, opts SearchOptions) (tupleResults, error)
+	FindTuples(query string, opts SearchOptions) (tupleResults, error)
+	CIDRTuples(prefix string, opts SearchOptions) (tupleResults, error)
+	FindIndividual(value string, opts SearchOptions) (individualResults, error)
+	LikeTuples(query string, opts SearchOptions) (tupleResults, error)
+	LikeAnswers(name string, opts SearchOptions) (tupleResults, error)
+	LikeIndividual(value string, opts SearchOptions) (individualResults, error)
+	GlobTuples(pattern string, opts SearchOptions) (tupleResults, error)
+	GlobQueryTuples(pattern string, opts SearchOptions) (tupleResults, error)
+	GlobAnswers(pattern string, opts SearchOptions) (tupleResults, error)
+	GlobIndividual(pattern string, opts SearchOptions) (individualResults, error)
+	ContainsTuples(substring string, opts SearchOptions) (tupleResults, error)
+	ContainsIndividual(substring string, opts SearchOptions) (individualResults, error)
+	ExportTuples(opts SearchOptions, fn func(tupleResult) error) error
+	FindRcodes(query string, opts SearchOptions) (rcodeResults, error)
+	LikeRcodes(query string, opts SearchOptions) (rcodeResults, error)
 	DeleteOld(days int64) (int64, error)
 	Close() error
 }
 
+//SearchOptions narrows down and shapes the results of the Find and Like
+//methods. The zero value searches everything.
+type SearchOptions struct {
+	//Sensor only returns what was seen by one sensor
+	Sensor string
+	//BySensor returns a row per sensor instead of merging them
+	BySensor bool
+	//RawPrefix makes the Like methods match any string prefix instead of
+	//whole labels, so google.com also finds evilgoogle.com
+	RawPrefix bool
+	//RRTypes only returns tuples with an answer of one of these types, like
+	//MX or AAAA. Other searches ignore it.
+	RRTypes []string
+	//The time fences only return records first or last seen after or
+	//before a time. A zero time isn't checked. When sensors are merged
+	//they apply to the merged first and last times.
+	FirstAfter  time.Time
+	FirstBefore time.Time
+	LastAfter   time.Time
+	LastBefore  time.Time
+	//Limit returns at most that many records, after skipping the first
+	//Offset of them. The default of 0 returns everything, an Offset needs
+	//a Limit.
+	Limit  int
+	Offset int
+	//Sort orders records by name, count, first or last, prefixed with - to
+	//reverse the order. Records are sorted by name by default.
+	Sort string
+}
+
+func (o SearchOptions) perSensor() bool {
+	return o.BySensor || o.Sensor != ""
+}
+
+//check rejects options a search can't be made with, instead of quietly
+//returning everything
+func (o SearchOptions) check() error {
+	if o.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", o.Limit)
+	}
+	if o.Offset < 0 {
+		return fmt.Errorf("invalid offset %d", o.Offset)
+	}
+	if o.Offset > 0 && o.Limit == 0 {
+		return errors.New("an offset needs a limit")
+	}
+	switch strings.TrimPrefix(o.Sort, "-") {
+	case "", "name", "count", "first", "last":
+		return nil
+	}
+	return fmt.Errorf("invalid sort order %q, use name, count, first or last", o.Sort)
+}
+
+//pageOptions asks for one more record than a page holds. If it is found
+//there is a next page, without having to count everything that matched.
+func (o SearchOptions) pageOptions() SearchOptions {
+	if o.Limit > 0 {
+		o.Limit++
+	}
+	return o
+}
+
+//tuplePage, individualPage and rcodePage run a search for a page of
+//opts.Limit records with one of the Store methods, and report whether it
+//was truncated because more records matched
+func tuplePage(search func(string, SearchOptions) (tupleResults, error), value string, opts SearchOptions) (tupleResults, bool, error) {
+	recs, err := search(value, opts.pageOptions())
+	if err != nil {
+		return recs, false, err
+	}
+	recs, more := recs.truncate(opts.Limit)
+	return recs, more, nil
+}
+func individualPage(search func(string, SearchOptions) (individualResults, error), value string, opts SearchOptions) (individualResults, bool, error) {
+	recs, err := search(value, opts.pageOptions())
+	if err != nil {
+		return recs, false, err
+	}
+	recs, more := recs.truncate(opts.Limit)
+	return recs, more, nil
+}
+func rcodePage(search func(string, SearchOptions) (rcodeResults, error), value string, opts SearchOptions) (rcodeResults, bool, error) {
+	recs, err := search(value, opts.pageOptions())
+	if err != nil {
+		return recs, false, err
+	}
+	recs, more := recs.truncate(opts.Limit)
+	return recs, more, nil
+}
+
 type tupleResult struct {
-	Query  string
-	Type   string
-	Answer string
-	Count  uint
-	TTL    uint
-	First  string
-	Last   string
+	Sensor  string
+	Query   string
+	Type    string
+	RRType  string
+	Answer  string
+	Count   uint
+	Clients uint
+	TTL     uint
+	First   string
+	Last    string
+	//Original is the first spelling of the query that had to be normalized
+	Original string
 }
 
 type tupleResults []tupleResult
@@ -41,25 +148,46 @@ func (tr tupleResults) Display() {
 	if len(tr) == 0 {
 		return
 	}
-	header := []string{"Query", "Type", "Answer", "Count", "TTL", "First", "Last"}
+	header := []string{"Query", "Type", "RRType", "Answer", "Count", "Clients", "TTL", "First", "Last", "Original"}
+	bySensor := tr[0].Sensor != ""
+	if bySensor {
+		header = append([]string{"Sensor"}, header...)
+	}
 	fmt.Println(strings.Join(header, "\t"))
 	for _, rec := range tr {
+		if bySensor {
+			fmt.Printf("%s\t", rec.Sensor)
+		}
 		fmt.Println(rec)
 	}
 }
+
+//truncate cuts results found with pageOptions down to a page of limit
+//records, and reports whether there were more
+func (tr tupleResults) truncate(limit int) (tupleResults, bool) {
+	if limit > 0 && len(tr) > limit {
+		return tr[:limit], true
+	}
+	return tr, false
+}
 func (tr tupleResult) String() string {
 	count := fmt.Sprintf("%d", tr.Count)
+	clients := fmt.Sprintf("%d", tr.Clients)
 	ttl := fmt.Sprintf("%d", tr.TTL)
-	s := []string{tr.Query, tr.Type, tr.Answer, count, ttl, tr.First, tr.Last}
+	s := []string{tr.Query, tr.Type, tr.RRType, tr.Answer, count, clients, ttl, tr.First, tr.Last, tr.Original}
 	return strings.Join(s, "\t")
 }
 
 type individualResult struct {
-	Value string
-	Which string
-	Count uint
-	First string
-	Last  string
+	Sensor  string
+	Value   string
+	Which   string
+	Count   uint
+	Clients uint
+	First   string
+	Last    string
+	//Original is the same as in tupleResult, for queries
+	Original string
 }
 type individualResults []individualResult
 
@@ -67,15 +195,69 @@ func (ir individualResults) Display() {
 	if len(ir) == 0 {
 		return
 	}
-	header := []string{"Value", "Which", "Count", "First", "Last"}
+	header := []string{"Value", "Which", "Count", "Clients", "First", "Last", "Original"}
+	bySensor := ir[0].Sensor != ""
+	if bySensor {
+		header = append([]string{"Sensor"}, header...)
+	}
 	fmt.Println(strings.Join(header, "\t"))
 	for _, rec := range ir {
+		if bySensor {
+			fmt.Printf("%s\t", rec.Sensor)
+		}
 		fmt.Println(rec)
 	}
 }
+func (ir individualResults) truncate(limit int) (individualResults, bool) {
+	if limit > 0 && len(ir) > limit {
+		return ir[:limit], true
+	}
+	return ir, false
+}
 func (ir individualResult) String() string {
 	count := fmt.Sprintf("%d", ir.Count)
-	s := []string{ir.Value, ir.Which, count, ir.First, ir.Last}
+	clients := fmt.Sprintf("%d", ir.Clients)
+	s := []string{ir.Value, ir.Which, count, clients, ir.First, ir.Last, ir.Original}
+	return strings.Join(s, "\t")
+}
+
+type rcodeResult struct {
+	Sensor string
+	Query  string
+	Type   string
+	Rcode  string
+	Count  uint
+	First  string
+	Last   string
+}
+type rcodeResults []rcodeResult
+
+func (rr rcodeResults) Display() {
+	if len(rr) == 0 {
+		return
+	}
+	header := []string{"Query", "Type", "Rcode", "Count", "First", "Last"}
+	bySensor := rr[0].Sensor != ""
+	if bySensor {
+		header = append([]string{"Sensor"}, header...)
+	}
+	fmt.Println(strings.Join(header, "\t"))
+	for _, rec := range rr {
+		if bySensor {
+			fmt.Printf("%s\t", rec.Sensor)
+		}
+		fmt.Println(rec)
+	}
+}
+func (rr rcodeResults) truncate(limit int) (rcodeResults, bool) {
+	if limit > 0 && len(rr) > limit {
+		return rr[:limit], true
+	}
+	return rr, false
+}
+func (rr rcodeResult) String() string {
+	count := fmt.Sprintf("%d", rr.Count)
+	s := []string{rr.Query, rr.Type, rr.Rcode, count, rr.First, rr.Last}
 	return strings.Join(s, "\t")
 }
 
@@ -106,18 +288,3 @@ func NewStore(storeType string, filename string) (Store, error) {
 	}
 	return s, err
 }
-
-//ToTS ensures a string is a unix timestamp
-//Yes, this is terrible, but supporting both timestamps and iso8601 at the same
-//time is tricky
-func ToTS(t string) string {
-	//If it doesn't have a dash, it should be a unix timestamp already
-	if !strings.Contains(t, "-") {
-		return t
-	}
-	parsed, err := time.Parse(time.RFC3339, t)
-	if err != nil {
-		log.Fatalf("Unparsable timestamp, don't know what to do here: %v", t)
-	}
-	return fmt.Sprintf("%d", parsed.Unix())
-}
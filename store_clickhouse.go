@@ -3,7 +3,10 @@ package main
 import (
 	"database/sql"
 	"fmt"
+	"log"
+	"net"
 	"net/url"
+	"strings"
 	"time"
 
 	_ "github.com/ClickHouse/clickhouse-go"
@@ -14,30 +17,53 @@ var chschema = []string{
 	`
 CREATE TABLE IF NOT EXISTS tuples (
     whatever Date DEFAULT '2000-01-01',
+    sensor String,
     query String,
     type String,
+    rrtype String,
     answer String,
+    answer_ip Nullable(IPv6),
+    answer_rev String,
     ttl AggregateFunction(anyLast, UInt16),
-    first AggregateFunction(min, DateTime),
-    last AggregateFunction(max, DateTime),
-    count AggregateFunction(sum, UInt64)
-  ) ENGINE = AggregatingMergeTree(whatever, (query, type, answer), 8192);
+    first AggregateFunction(min, DateTime64(6)),
+    last AggregateFunction(max, DateTime64(6)),
+    count AggregateFunction(sum, UInt64),
+    clients AggregateFunction(maxMap, Array(UInt16), Array(UInt8)),
+    original AggregateFunction(argMin, String, DateTime64(6)),
+    INDEX tuples_answer_rev answer_rev TYPE ngrambf_v1(4, 1024, 3, 0) GRANULARITY 4
+  ) ENGINE = AggregatingMergeTree(whatever, (query, type, rrtype, answer, sensor), 8192);
 `,
 
 	`
 CREATE TABLE IF NOT EXISTS individual (
     whatever Date DEFAULT '2000-01-01',
+    sensor String,
     which Enum8('Q'=0, 'A'=1),
     value String,
-    first AggregateFunction(min, DateTime),
-    last AggregateFunction(max, DateTime),
+    first AggregateFunction(min, DateTime64(6)),
+    last AggregateFunction(max, DateTime64(6)),
+    count AggregateFunction(sum, UInt64),
+    clients AggregateFunction(maxMap, Array(UInt16), Array(UInt8)),
+    original AggregateFunction(argMin, String, DateTime64(6))
+  ) ENGINE = AggregatingMergeTree(whatever, (which, value, sensor), 8192);
+`,
+	`
+CREATE TABLE IF NOT EXISTS rcodes (
+    whatever Date DEFAULT '2000-01-01',
+    sensor String,
+    query String,
+    type String,
+    rcode String,
+    first AggregateFunction(min, DateTime64(6)),
+    last AggregateFunction(max, DateTime64(6)),
     count AggregateFunction(sum, UInt64)
-  ) ENGINE = AggregatingMergeTree(whatever, (which, value), 8192);
+  ) ENGINE = AggregatingMergeTree(whatever, (query, type, rcode, sensor), 8192);
 `,
 	`
 CREATE TABLE IF NOT EXISTS filenames (
 	day Date DEFAULT toDate(ts),
 	ts DateTime DEFAULT now(),
+	sensor String,
 	filename String,
 	aggregation_time Float64,
 	total_records UInt64,
@@ -47,29 +73,87 @@ CREATE TABLE IF NOT EXISTS filenames (
 	store_time Float64,
 	inserted UInt64,
 	updated UInt64
-  ) ENGINE = MergeTree(day, (filename), 8192);
+  ) ENGINE = MergeTree(day, (sensor, filename), 8192);
 `}
 
 const tuples_temp_stmt = `
 CREATE TEMPORARY TABLE tuples_temp (
+    sensor String,
     query String,
     type String,
+    rrtype String,
     answer String,
+    answer_ip Nullable(String),
+    answer_rev String,
     ttl String,
-    first String,
-    last String,
-    count UInt64
+    first DateTime64(6),
+    last DateTime64(6),
+    count UInt64,
+    client_regs Array(UInt16),
+    client_rhos Array(UInt16),
+    original String
 ) ENGINE = Memory`
 
 const individual_temp_stmt = `
 CREATE TEMPORARY TABLE individual_temp (
+    sensor String,
     which Enum8('Q'=0, 'A'=1),
     value String,
-    first String,
-    last String,
+    first DateTime64(6),
+    last DateTime64(6),
+    count UInt64,
+    client_regs Array(UInt16),
+    client_rhos Array(UInt16),
+    original String
+) ENGINE = Memory`
+
+const rcodes_temp_stmt = `
+CREATE TEMPORARY TABLE rcodes_temp (
+    sensor String,
+    query String,
+    type String,
+    rcode String,
+    first DateTime64(6),
+    last DateTime64(6),
     count UInt64
 ) ENGINE = Memory`
 
+//The clients are the same HLL registers the other stores keep, as a maxMap
+//of register to value so clickhouse merges them like hll.merge does.
+//uniqState can't be built from a sketch. The merged registers are turned
+//back into the sketch format and the count is estimated like it is for
+//the other stores.
+const chClientsState = `maxMapState(client_regs, arrayMap(x -> toUInt8(x), client_rhos))`
+const chClients = `arrayStringConcat(arrayMap((r, v) -> char(intDiv(r, 256), r % 256, v), (maxMapMerge(clients) AS client_map).1, client_map.2)) as client_sketch`
+
+//The original spelling is the one seen first. Rows without one sort last,
+//so they only win when no spelling was ever kept.
+const chOriginalState = `argMinState(original, if(original = '', toDateTime64('2200-01-01 00:00:00', 6), first))`
+const chOriginal = `argMinMerge(original) as original`
+
+//chIP formats an address for an IPv6 column, IPv4 addresses are stored
+//IPv4-mapped
+func chIP(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+//chSubstringSchema adds n-gram bloom filters that let LIKE patterns starting
+//with a wildcard skip most granules. Existing parts are indexed too.
+var chSubstringSchema = []string{
+	"ALTER TABLE tuples ADD INDEX IF NOT EXISTS tuples_query_ngram query TYPE ngrambf_v1(3, 8192, 3, 0) GRANULARITY 4",
+	"ALTER TABLE tuples ADD INDEX IF NOT EXISTS tuples_answer_ngram answer TYPE ngrambf_v1(3, 8192, 3, 0) GRANULARITY 4",
+	"ALTER TABLE individual ADD INDEX IF NOT EXISTS individual_value_ngram value TYPE ngrambf_v1(3, 8192, 3, 0) GRANULARITY 4",
+	"ALTER TABLE tuples MATERIALIZE INDEX tuples_query_ngram",
+	"ALTER TABLE tuples MATERIALIZE INDEX tuples_answer_ngram",
+	"ALTER TABLE individual MATERIALIZE INDEX individual_value_ngram",
+}
+
 type CHStore struct {
 	conn *sqlx.DB
 }
@@ -103,6 +187,12 @@ func (s *CHStore) Exec(stmt string) error {
 }
 
 func (s *CHStore) Init() error {
+	for _, table := range []string{"tuples", "individual", "rcodes", "filenames"} {
+		err := s.migrate(table)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", table, err)
+		}
+	}
 	for _, stmt := range chschema {
 		err := s.Exec(stmt)
 		if err != nil {
@@ -111,10 +201,206 @@ func (s *CHStore) Init() error {
 	}
 	return nil
 }
+
+//chMigration brings a table created by an older version up to date. The
+//sorting key and the types of aggregate states can't be altered, so tables
+//that differ in those are copied into a new table with the current schema.
+type chMigration struct {
+	//key are the columns of the sorting key added since the table was
+	//first released, fill computes new columns for old rows
+	key  []string
+	fill map[string]string
+	//types are the current types of columns whose type changed and
+	//convert turns a value of the old type into the new one
+	types   map[string]string
+	convert map[string]string
+	//added are other columns added since, they are added in place
+	added []chColumn
+	//indexes are the skipping indexes on added columns
+	indexes map[string]string
+}
+
+var chMigrations = map[string]chMigration{
+	"tuples": {
+		key: []string{"rrtype", "sensor"},
+		fill: map[string]string{
+			"rrtype":    chAnswerType,
+			"sensor":    "''",
+			"answer_ip": "if(rrtype IN ('A', 'AAAA'), toIPv6OrNull(if(isIPv4String(answer), concat('::ffff:', answer), answer)), NULL)",
+			//The types isNameType in normalize.go lists
+			"answer_rev": "if(rrtype IN ('CNAME', 'DNAME', 'NS', 'PTR', 'MX', 'SRV'), reverseUTF8(answer), '')",
+		},
+		types: map[string]string{
+			"first": "AggregateFunction(min, DateTime64(6))",
+			"last":  "AggregateFunction(max, DateTime64(6))",
+		},
+		convert: chTimeConversions,
+		added:   []chColumn{chClientsColumn, {Name: "answer_ip", Type: "Nullable(IPv6)"}, {Name: "answer_rev", Type: "String"}, chOriginalColumn},
+		indexes: map[string]string{"answer_rev": "tuples_answer_rev answer_rev TYPE ngrambf_v1(4, 1024, 3, 0) GRANULARITY 4"},
+	},
+	"individual": {
+		key:  []string{"sensor"},
+		fill: map[string]string{"sensor": "''"},
+		types: map[string]string{
+			"first": "AggregateFunction(min, DateTime64(6))",
+			"last":  "AggregateFunction(max, DateTime64(6))",
+		},
+		convert: chTimeConversions,
+		added:   []chColumn{chClientsColumn, chOriginalColumn},
+	},
+	"rcodes": {
+		key:  []string{"sensor"},
+		fill: map[string]string{"sensor": "''"},
+	},
+	"filenames": {
+		key:  []string{"sensor"},
+		fill: map[string]string{"sensor": "''"},
+	},
+}
+
+var chClientsColumn = chColumn{Name: "clients", Type: "AggregateFunction(maxMap, Array(UInt16), Array(UInt8))"}
+var chOriginalColumn = chColumn{Name: "original", Type: "AggregateFunction(argMin, String, DateTime64(6))"}
+
+//chAnswerType is answerType for rows stored before the type of each answer
+//was
+const chAnswerType = "multiIf(isIPv4String(answer), 'A', isIPv6String(answer), 'AAAA', type IN ('A', 'AAAA', 'A6'), 'CNAME', type)"
+
+//chTimeConversions turn the first and last states of tables from before
+//microseconds were kept into the current ones
+var chTimeConversions = map[string]string{
+	"first": "initializeAggregation('minState', toDateTime64(finalizeAggregation(first), 6))",
+	"last":  "initializeAggregation('maxState', toDateTime64(finalizeAggregation(last), 6))",
+}
+
+type chColumn struct {
+	Name string `db:"name"`
+	Type string `db:"type"`
+}
+
+//tableColumns returns the columns of table in order, or nothing when it
+//doesn't exist yet
+func (s *CHStore) tableColumns(table string) ([]chColumn, error) {
+	var cols []chColumn
+	err := s.conn.Select(&cols, "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ? ORDER BY position", table)
+	return cols, err
+}
+
+func (s *CHStore) migrate(table string) error {
+	cols, err := s.tableColumns(table)
+	if err != nil || len(cols) == 0 {
+		return err
+	}
+	m := chMigrations[table]
+	present := make(map[string]bool)
+	for _, col := range cols {
+		present[col.Name] = true
+	}
+	for _, name := range m.key {
+		if !present[name] {
+			return s.rebuild(table, cols, m)
+		}
+	}
+	for _, col := range cols {
+		if typ, ok := m.types[col.Name]; ok && typ != col.Type {
+			return s.rebuild(table, cols, m)
+		}
+	}
+	for _, col := range m.added {
+		if present[col.Name] {
+			continue
+		}
+		log.Printf("Adding the %s column to the clickhouse %s table", col.Name, table)
+		err = s.Exec("ALTER TABLE " + table + " ADD COLUMN " + col.Name + " " + col.Type)
+		if err != nil {
+			return err
+		}
+		if fill := m.fill[col.Name]; fill != "" {
+			err = s.Exec("ALTER TABLE " + table + " UPDATE " + col.Name + " = " + fill + " WHERE 1")
+			if err != nil {
+				return err
+			}
+		}
+		if index := m.indexes[col.Name]; index != "" {
+			err = s.Exec("ALTER TABLE " + table + " ADD INDEX " + index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//chCreate returns the statement in chschema that creates table
+func chCreate(table string) string {
+	for _, stmt := range chschema {
+		if strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			return stmt
+		}
+	}
+	return ""
+}
+
+//rebuild copies an old table into one with the current schema and swaps
+//them. The old table is only dropped once everything was copied.
+func (s *CHStore) rebuild(table string, oldCols []chColumn, m chMigration) error {
+	log.Printf("Migrating the clickhouse %s table to the current schema", table)
+	tmp := table + "_migrate"
+	err := s.Exec("DROP TABLE IF EXISTS " + tmp)
+	if err != nil {
+		return err
+	}
+	err = s.Exec(strings.Replace(chCreate(table), "CREATE TABLE IF NOT EXISTS "+table+" (", "CREATE TABLE "+tmp+" (", 1))
+	if err != nil {
+		return err
+	}
+	old := make(map[string]string)
+	for _, col := range oldCols {
+		old[col.Name] = col.Type
+	}
+	cols, err := s.tableColumns(tmp)
+	if err != nil {
+		return err
+	}
+	var names, values []string
+	for _, col := range cols {
+		typ, ok := old[col.Name]
+		value := col.Name
+		switch {
+		case !ok && m.fill[col.Name] != "":
+			//Aliased so the other fills can use it
+			value = m.fill[col.Name] + " AS " + col.Name
+		case !ok:
+			continue
+		case typ != col.Type && m.convert[col.Name] != "":
+			value = m.convert[col.Name]
+		}
+		names = append(names, col.Name)
+		values = append(values, value)
+	}
+	err = s.Exec("INSERT INTO " + tmp + " (" + strings.Join(names, ", ") + ") SELECT " + strings.Join(values, ", ") + " FROM " + table)
+	if err != nil {
+		return err
+	}
+	err = s.Exec("RENAME TABLE " + table + " TO " + table + "_old, " + tmp + " TO " + table)
+	if err != nil {
+		return err
+	}
+	return s.Exec("DROP TABLE " + table + "_old")
+}
+func (s *CHStore) InitSubstringIndex() error {
+	for _, stmt := range chSubstringSchema {
+		err := s.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (s *CHStore) Clear() error {
 	stmts := []string{
 		"drop table filenames",
 		"drop table individual",
+		"drop table rcodes",
 		"drop table tuples",
 	}
 	for _, stmt := range stmts {
@@ -133,6 +419,9 @@ func (s *CHStore) Commit() error {
 	//log.Printf("clickhouse doesn't support transactions")
 	return nil
 }
+func (s *CHStore) Rollback() error {
+	return nil
+}
 
 //DeleteOld Deletes records that haven't been seen in DAYS, returns the total records deleted
 func (s *CHStore) DeleteOld(days int64) (int64, error) {
@@ -146,6 +435,7 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 
 	s.Exec("DROP TABLE tuples_temp")
 	s.Exec("DROP TABLE individual_temp")
+	s.Exec("DROP TABLE rcodes_temp")
 
 	err = s.Exec(tuples_temp_stmt)
 	if err != nil {
@@ -155,14 +445,18 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
 	}
+	err = s.Exec(rcodes_temp_stmt)
+	if err != nil {
+		return result, fmt.Errorf("CHStore.Update failed: %w", err)
+	}
 
 	tx, err := s.conn.Begin()
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
 	}
 	stmt, err := tx.Prepare(`INSERT INTO tuples_temp
-		(query, type, answer, ttl, first, last, count)
-		values (?,?,?,?,?,?,?)`,
+		(sensor, query, type, rrtype, answer, answer_ip, answer_rev, ttl, first, last, count, client_regs, client_rhos, original)
+		values (?,?,?,?,?,?,?,?,?,?,?,?,?,?)`,
 	)
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
@@ -172,7 +466,8 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 	for _, q := range ar.Tuples {
 		//Update the tuples table
 		query := Reverse(q.query)
-		_, err := stmt.Exec(query, q.qtype, q.answer, q.ttl, ToTS(q.first), ToTS(q.last), uint64(q.count))
+		regs, rhos := q.clients.registers()
+		_, err := stmt.Exec(ar.Sensor, query, q.qtype, q.rrtype, q.answer, chIP(answerIP(q.rrtype, q.answer)), reversedAnswer(q.rrtype, q.answer), q.ttl, q.first, q.last, uint64(q.count), regs, rhos, q.original)
 		if err != nil {
 			return result, fmt.Errorf("CHStore.Update failed to run query: %w", err)
 		}
@@ -181,12 +476,16 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
 	}
-	err = s.Exec(`INSERT INTO tuples (query, type, answer, ttl, first, last, count) SELECT
-		query, type, answer,
+	err = s.Exec(`INSERT INTO tuples (sensor, query, type, rrtype, answer, answer_ip, answer_rev, ttl, first, last, count, clients, original) SELECT
+		sensor, query, type, rrtype, answer,
+		any(toIPv6(answer_ip)),
+		any(answer_rev),
 		anyLastState(toUInt16(ttl)),
-		minState(toDateTime(toFloat64(first))),
-		maxState(toDateTime(toFloat64(last))),
-		sumState(count) from tuples_temp group by query, type, answer`,
+		minState(first),
+		maxState(last),
+		sumState(count),
+		` + chClientsState + `,
+		` + chOriginalState + ` from tuples_temp group by sensor, query, type, rrtype, answer`,
 	)
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
@@ -198,8 +497,8 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 	}
 	// Individuals
 	stmt, err = tx.Prepare(`INSERT INTO individual_temp
-		(value, which, first, last, count)
-		values (?,?,?,?,?)`,
+		(sensor, value, which, first, last, count, client_regs, client_rhos, original)
+		values (?,?,?,?,?,?,?,?,?)`,
 	)
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
@@ -210,7 +509,8 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 		if q.which == "Q" {
 			value = Reverse(value)
 		}
-		_, err := stmt.Exec(value, q.which, ToTS(q.first), ToTS(q.last), uint64(q.count))
+		regs, rhos := q.clients.registers()
+		_, err := stmt.Exec(ar.Sensor, value, q.which, q.first, q.last, uint64(q.count), regs, rhos, q.original)
 		if err != nil {
 			return result, fmt.Errorf("CHStore.Update failed to run query: %w", err)
 		}
@@ -219,22 +519,54 @@ func (s *CHStore) Update(ar aggregationResult) (UpdateResult, error) {
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
 	}
-	err = s.Exec(`INSERT INTO individual (which, value, first, last, count) SELECT which, value,
-	minState(toDateTime(toFloat64(first))),
-	maxState(toDateTime(toFloat64(last))),
-	sumState(count) from individual_temp group by which, value`)
+	err = s.Exec(`INSERT INTO individual (sensor, which, value, first, last, count, clients, original) SELECT sensor, which, value,
+	minState(first),
+	maxState(last),
+	sumState(count),
+	` + chClientsState + `,
+	` + chOriginalState + ` from individual_temp group by sensor, which, value`)
 	if err != nil {
 		return result, fmt.Errorf("CHStore.Update failed: %w", err)
 	}
 
-	result.Updated = uint(ar.TuplesLen + ar.IndividualLen)
+	tx, err = s.conn.Begin()
+	if err != nil {
+		return result, fmt.Errorf("CHStore.Update failed: %w", err)
+	}
+	// Rcodes
+	stmt, err = tx.Prepare(`INSERT INTO rcodes_temp
+		(sensor, query, type, rcode, first, last, count)
+		values (?,?,?,?,?,?,?)`,
+	)
+	if err != nil {
+		return result, fmt.Errorf("CHStore.Update failed: %w", err)
+	}
+	for _, q := range ar.Rcodes {
+		_, err := stmt.Exec(ar.Sensor, Reverse(q.query), q.qtype, q.rcode, q.first, q.last, uint64(q.count))
+		if err != nil {
+			return result, fmt.Errorf("CHStore.Update failed to run query: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return result, fmt.Errorf("CHStore.Update failed: %w", err)
+	}
+	err = s.Exec(`INSERT INTO rcodes (sensor, query, type, rcode, first, last, count) SELECT sensor, query, type, rcode,
+	minState(first),
+	maxState(last),
+	sumState(count) from rcodes_temp group by sensor, query, type, rcode`)
+	if err != nil {
+		return result, fmt.Errorf("CHStore.Update failed: %w", err)
+	}
+
+	result.Updated = uint(ar.TuplesLen + ar.IndividualLen + ar.RcodesLen)
 	result.Duration = time.Since(start)
 	return result, nil
 }
 
-func (s *CHStore) IsLogIndexed(filename string) (bool, error) {
+func (s *CHStore) IsLogIndexed(sensor string, filename string) (bool, error) {
 	var fn string
-	err := s.conn.QueryRow("SELECT filename FROM filenames WHERE filename=?", filename).Scan(&fn)
+	err := s.conn.QueryRow("SELECT filename FROM filenames WHERE sensor=? AND filename=?", sensor, filename).Scan(&fn)
 	switch {
 	case err == sql.ErrNoRows:
 		return false, nil
@@ -244,13 +576,13 @@ func (s *CHStore) IsLogIndexed(filename string) (bool, error) {
 		return true, nil
 	}
 }
-func (s *CHStore) SetLogIndexed(filename string, ar aggregationResult, ur UpdateResult) error {
+func (s *CHStore) SetLogIndexed(sensor string, filename string, ar aggregationResult, ur UpdateResult) error {
 	tx, _ := s.conn.Begin()
-	q := `INSERT INTO filenames (filename,
+	q := `INSERT INTO filenames (sensor, filename,
 	      aggregation_time, total_records, skipped_records, tuples, individual,
 	      store_time, inserted, updated)
-	      VALUES (?,?,?,?,?,?,?,?,?)`
-	_, err := tx.Exec(q, filename,
+	      VALUES (?,?,?,?,?,?,?,?,?,?)`
+	_, err := tx.Exec(q, sensor, filename,
 		ar.Duration.Seconds(), uint64(ar.TotalRecords), uint64(ar.SkippedRecords), len(ar.Tuples), len(ar.Individual),
 		ur.Duration.Seconds(), uint64(ur.Inserted), uint64(ur.Updated))
 	if err != nil {
@@ -259,40 +591,162 @@ func (s *CHStore) SetLogIndexed(filename string, ar aggregationResult, ur Update
 	return tx.Commit()
 }
 
-func (s *CHStore) FindQueryTuples(query string) (tupleResults, error) {
-	tr := []tupleResult{}
-	query = Reverse(query)
-	err := s.conn.Select(&tr, "SELECT * FROM tuples WHERE query = ?", query)
-	reverseQuery(tr)
-	return tr, err
+//chGroupBy returns the columns to group a search by, with the sensor first
+//when every sensor gets its own row
+func chGroupBy(columns string, opts SearchOptions) string {
+	if opts.perSensor() {
+		return "sensor, " + columns
+	}
+	return columns
 }
-func (s *CHStore) FindTuples(query string) (tupleResults, error) {
-	tr := []tupleResult{}
-	rquery := Reverse(query)
-	err := s.conn.Select(&tr, "SELECT query, type, answer, anyLastMerge(ttl) as ttl, minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count from tuples WHERE query = ? OR answer = ? group by query, type, answer ORDER BY query, answer", rquery, query)
-	reverseQuery(tr)
 
-	return tr, err
+//chHaving checks the time fences after merging, the first and last columns
+//only hold aggregate states. They are compared through the aliases for the
+//merged values, clickhouse would otherwise replace first and last inside
+//minMerge and maxMerge with those aliases.
+func chHaving(b *sqlBuilder, opts SearchOptions) string {
+	fences := timeFences(b, "first", "last", opts, func(b *sqlBuilder, t time.Time) string {
+		return b.arg(t.UTC())
+	})
+	if fences != "" {
+		return " HAVING " + fences
+	}
+	return ""
 }
-func (s *CHStore) LikeTuples(query string) (tupleResults, error) {
+
+func (s *CHStore) tuplesQuery(b *sqlBuilder, where string, opts SearchOptions) (string, error) {
+	groupBy := chGroupBy("query, type, rrtype, answer", opts)
+	q := "SELECT " + groupBy + ", anyLastMerge(ttl) as ttl, minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count, " + chClients + ", " + chOriginal +
+		" from tuples WHERE " + b.rrtypes(b.filter(where, opts), opts) + " group by " + groupBy + chHaving(b, opts)
+	order, err := orderBy(opts, "query, answer")
+	return q + order + limit(opts), err
+}
+
+func (s *CHStore) searchTuples(b *sqlBuilder, where string, opts SearchOptions) (tupleResults, error) {
 	tr := []tupleResult{}
-	rquery := Reverse(query)
-	err := s.conn.Select(&tr, "SELECT query, type, answer, anyLastMerge(ttl) as ttl, minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count from tuples WHERE query like ? OR answer like ? group by query, type, answer ORDER BY query, answer", rquery+"%", query+"%")
+	q, err := s.tuplesQuery(b, where, opts)
+	if err != nil {
+		return tr, err
+	}
+	var rows []sqlTuple
+	err = s.conn.Select(&rows, q, b.args...)
+	for _, row := range rows {
+		tr = append(tr, row.result())
+	}
 	reverseQuery(tr)
 	return tr, err
 }
-func (s *CHStore) FindIndividual(value string) (individualResults, error) {
-	rvalue := Reverse(value)
-	tr := []individualResult{}
-	err := s.conn.Select(&tr, `SELECT which, value, minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count from individual WHERE (which='A' AND value = ?) OR (which='Q' AND value = ?) group by which, value ORDER BY value`, value, rvalue)
-	reverseValue(tr)
-	return tr, err
+
+func (s *CHStore) ExportTuples(opts SearchOptions, fn func(tupleResult) error) error {
+	b := &sqlBuilder{}
+	q, err := s.tuplesQuery(b, "1=1", opts)
+	if err != nil {
+		return err
+	}
+	return eachTuple(s.conn, q, b.args, fn)
 }
 
-func (s *CHStore) LikeIndividual(value string) (individualResults, error) {
-	rvalue := Reverse(value)
+func (s *CHStore) searchIndividual(b *sqlBuilder, where string, opts SearchOptions) (individualResults, error) {
 	tr := []individualResult{}
-	err := s.conn.Select(&tr, `SELECT which, value, minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count from individual WHERE (which='A' AND value like ?) OR (which='Q' AND value like ?) group by which, value ORDER BY value`, value+"%", rvalue+"%")
+	groupBy := chGroupBy("which, value", opts)
+	q := "SELECT " + groupBy + ", minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count, " + chClients + ", " + chOriginal +
+		" from individual WHERE " + b.filter(where, opts) + " group by " + groupBy + chHaving(b, opts)
+	order, err := orderBy(opts, "value")
+	if err != nil {
+		return tr, err
+	}
+	var rows []sqlIndividual
+	err = s.conn.Select(&rows, q+order+limit(opts), b.args...)
+	for _, row := range rows {
+		tr = append(tr, row.result())
+	}
 	reverseValue(tr)
 	return tr, err
 }
+
+func (s *CHStore) searchRcodes(b *sqlBuilder, where string, opts SearchOptions) (rcodeResults, error) {
+	rr := []rcodeResult{}
+	groupBy := chGroupBy("query, type, rcode", opts)
+	q := "SELECT " + groupBy + ", minMerge(first) as first, maxMerge(last) as last, sumMerge(count) as count" +
+		" from rcodes WHERE " + b.filter(where, opts) + " group by " + groupBy + chHaving(b, opts)
+	order, err := orderBy(opts, "query, type, rcode")
+	if err != nil {
+		return rr, err
+	}
+	err = s.conn.Select(&rr, q+order+limit(opts), b.args...)
+	reverseRcodeQuery(rr)
+	return rr, err
+}
+
+//CIDRTuples finds the tuples with an address answer inside prefix
+func (s *CHStore) CIDRTuples(prefix string, opts SearchOptions) (tupleResults, error) {
+	lo, hi, err := ipRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	b := &sqlBuilder{}
+	where := "answer_ip BETWEEN toIPv6(" + b.arg(chIP(lo)) + ") AND toIPv6(" + b.arg(chIP(hi)) + ")"
+	return s.searchTuples(b, where, opts)
+}
+
+func (s *CHStore) FindQueryTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, queryTuplesWhere(b, query), opts)
+}
+func (s *CHStore) FindTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, tuplesWhere(b, query), opts)
+}
+func (s *CHStore) LikeTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, likeTuplesWhere(b, query, opts), opts)
+}
+func (s *CHStore) LikeAnswers(name string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, likeAnswersWhere(b, name, opts), opts)
+}
+func (s *CHStore) GlobTuples(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, globTuplesWhere(b, pattern), opts)
+}
+func (s *CHStore) ContainsTuples(substring string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, containsTuplesWhere(b, substring), opts)
+}
+func (s *CHStore) GlobQueryTuples(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, globQueryTuplesWhere(b, pattern), opts)
+}
+func (s *CHStore) GlobAnswers(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := &sqlBuilder{}
+	return s.searchTuples(b, globAnswersWhere(b, pattern), opts)
+}
+func (s *CHStore) FindIndividual(value string, opts SearchOptions) (individualResults, error) {
+	b := &sqlBuilder{}
+	return s.searchIndividual(b, individualWhere(b, value), opts)
+}
+
+func (s *CHStore) LikeIndividual(value string, opts SearchOptions) (individualResults, error) {
+	b := &sqlBuilder{}
+	return s.searchIndividual(b, likeIndividualWhere(b, value, opts), opts)
+}
+
+func (s *CHStore) GlobIndividual(pattern string, opts SearchOptions) (individualResults, error) {
+	b := &sqlBuilder{}
+	return s.searchIndividual(b, globIndividualWhere(b, pattern), opts)
+}
+
+func (s *CHStore) ContainsIndividual(substring string, opts SearchOptions) (individualResults, error) {
+	b := &sqlBuilder{}
+	return s.searchIndividual(b, containsIndividualWhere(b, substring), opts)
+}
+
+func (s *CHStore) FindRcodes(query string, opts SearchOptions) (rcodeResults, error) {
+	b := &sqlBuilder{}
+	return s.searchRcodes(b, rcodesWhere(b, query), opts)
+}
+
+func (s *CHStore) LikeRcodes(query string, opts SearchOptions) (rcodeResults, error) {
+	b := &sqlBuilder{}
+	return s.searchRcodes(b, likeRcodesWhere(b, query, opts), opts)
+}
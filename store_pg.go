@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -15,34 +16,58 @@ import (
 const pgschema = `
 set synchronous_commit to off;
 CREATE TABLE IF NOT EXISTS tuples (
+	sensor text NOT NULL DEFAULT '',
 	query text,
 	type text,
+	rrtype text,
 	answer text,
+	answer_ip inet,
+	answer_rev text NOT NULL DEFAULT '',
 	count bigint,
+	clients bytea,
 	ttl integer,
 	first timestamp,
 	last timestamp,
-	PRIMARY KEY (query, type, answer)
+	original text,
+	PRIMARY KEY (query, type, rrtype, answer, sensor)
 ) ;
-CREATE INDEX tuples_query ON tuples(query varchar_pattern_ops);
-CREATE INDEX tuples_answer ON tuples(answer varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS tuples_query ON tuples(query varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS tuples_answer ON tuples(answer varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS tuples_answer_ip ON tuples(answer_ip);
+CREATE INDEX IF NOT EXISTS tuples_answer_rev ON tuples(answer_rev varchar_pattern_ops);
 -- CREATE INDEX tuples_first ON tuples(first);
 -- CREATE INDEX tuples_last ON tuples(last);
 
 CREATE TABLE IF NOT EXISTS individual (
+	sensor text NOT NULL DEFAULT '',
 	which char(1),
 	value text,
 	count bigint,
+	clients bytea,
 	first timestamp,
 	last timestamp,
-	PRIMARY KEY (which, value)
+	original text,
+	PRIMARY KEY (which, value, sensor)
 );
-CREATE INDEX individual_value ON individual(value varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS individual_value ON individual(value varchar_pattern_ops);
 -- CREATE INDEX individual_first ON individual(first);
 -- CREATE INDEX individual_last ON individual(last);
 
+CREATE TABLE IF NOT EXISTS rcodes (
+	sensor text NOT NULL DEFAULT '',
+	query text,
+	type text,
+	rcode text,
+	count bigint,
+	first timestamp,
+	last timestamp,
+	PRIMARY KEY (query, type, rcode, sensor)
+);
+CREATE INDEX IF NOT EXISTS rcodes_query ON rcodes(query varchar_pattern_ops);
+
 CREATE TABLE IF NOT EXISTS filenames (
-	filename text PRIMARY KEY UNIQUE NOT NULL,
+	sensor text NOT NULL DEFAULT '',
+	filename text NOT NULL,
 	time timestamp DEFAULT now(),
 	aggregation_time real,
 	total_records int,
@@ -51,17 +76,30 @@ CREATE TABLE IF NOT EXISTS filenames (
 	individual int,
 	store_time real,
 	inserted int,
-	updated int
+	updated int,
+	PRIMARY KEY (sensor, filename)
 );
-CREATE OR REPLACE FUNCTION update_individual(w char(1), v text, c integer,f timestamp,l timestamp) RETURNS CHAR(1) AS
+-- The functions of databases created before the sensor and rrtype keys,
+-- which would still update rows by the old keys
+DROP FUNCTION IF EXISTS update_individual(char(1), text, integer, timestamp, timestamp);
+DROP FUNCTION IF EXISTS update_tuples(text, text, text, integer, integer, timestamp, timestamp);
+
+CREATE OR REPLACE FUNCTION update_individual(w char(1), v text, c integer,f timestamp,l timestamp, cl bytea, se text, og text) RETURNS CHAR(1) AS
 $$
+DECLARE
+    -- cl was merged with the stored sketch by Update, unless the row was
+    -- inserted by someone else since. Concatenated sketches are read as
+    -- their union.
+    inserted boolean := false;
 BEGIN
     LOOP
         -- first try to update the key
         UPDATE individual SET count=count+c,
         first=least(f, first),
-        last =greatest(l, last)
-        WHERE value=v AND which=w;
+        last =greatest(l, last),
+        clients=CASE WHEN inserted THEN coalesce(clients, ''::bytea) || cl ELSE cl END,
+        original=coalesce(original, og)
+        WHERE value=v AND which=w AND sensor=se;
         IF found THEN
             RETURN 'U';
         END IF;
@@ -69,27 +107,56 @@ BEGIN
         -- if someone else inserts the same key concurrently,
         -- we could get a unique-key failure
         BEGIN
-            INSERT INTO individual (value, which, count, first, last) VALUES (v,w,c,f,l);
+            INSERT INTO individual (value, which, count, first, last, clients, sensor, original) VALUES (v,w,c,f,l,cl,se,og);
             RETURN 'I';
         EXCEPTION WHEN unique_violation THEN
-            -- do nothing, and loop to try the UPDATE again
+            -- loop to try the UPDATE again
+            inserted := true;
         END;
     END LOOP;
 END;
 $$
 LANGUAGE plpgsql;
 
+CREATE OR REPLACE FUNCTION update_rcodes(q text, ty text, rc text, c integer, f timestamp, l timestamp, se text) RETURNS CHAR(1) AS
+$$
+BEGIN
+    LOOP
+        UPDATE rcodes SET count=count+c,
+        first=least(f, first),
+        last =greatest(l, last)
+        WHERE query=q AND type=ty AND rcode=rc AND sensor=se;
+        IF found THEN
+            RETURN 'U';
+        END IF;
+        BEGIN
+            INSERT INTO rcodes (query, type, rcode, count, first, last, sensor) VALUES (q, ty, rc, c, f, l, se);
+            RETURN 'I';
+        EXCEPTION WHEN unique_violation THEN
+            -- do nothing, and loop to try the UPDATE again
+        END;
+    END LOOP;
+END;
+$$
+LANGUAGE plpgsql;
 
-CREATE OR REPLACE FUNCTION update_tuples(q text, ty text, a text, tt integer, c integer ,f timestamp,l timestamp) RETURNS CHAR(1) AS
+CREATE OR REPLACE FUNCTION update_tuples(q text, ty text, rr text, a text, tt integer, c integer ,f timestamp,l timestamp, cl bytea, se text, og text) RETURNS CHAR(1) AS
 $$
+DECLARE
+    -- cl was merged with the stored sketch by Update, unless the row was
+    -- inserted by someone else since. Concatenated sketches are read as
+    -- their union.
+    inserted boolean := false;
 BEGIN
     LOOP
         -- first try to update the key
         UPDATE tuples SET count=count+c,
         ttl=tt,
         first=least(f, first),
-        last =greatest(l, last)
-        WHERE query=q AND  type=ty AND answer=a;
+        last =greatest(l, last),
+        clients=CASE WHEN inserted THEN coalesce(clients, ''::bytea) || cl ELSE cl END,
+        original=coalesce(original, og)
+        WHERE query=q AND  type=ty AND rrtype=rr AND answer=a AND sensor=se;
         IF found THEN
             RETURN 'U';
         END IF;
@@ -97,10 +164,15 @@ BEGIN
         -- if someone else inserts the same key concurrently,
         -- we could get a unique-key failure
         BEGIN
-            INSERT INTO tuples (query, type, answer, ttl, count, first, last) VALUES (q, ty, a, tt, c, f, l);
+            -- answer_rev is only set for the types isNameType in normalize.go lists
+            INSERT INTO tuples (query, type, rrtype, answer, answer_ip, answer_rev, ttl, count, first, last, clients, sensor, original)
+                VALUES (q, ty, rr, a, CASE WHEN rr IN ('A', 'AAAA') THEN pdns_inet(a) END,
+                    CASE WHEN rr IN ('CNAME', 'DNAME', 'NS', 'PTR', 'MX', 'SRV') THEN reverse(a) ELSE '' END,
+                    tt, c, f, l, cl, se, og);
             RETURN 'I';
         EXCEPTION WHEN unique_violation THEN
-            -- do nothing, and loop to try the UPDATE again
+            -- loop to try the UPDATE again
+            inserted := true;
         END;
     END LOOP;
 END;
@@ -108,6 +180,20 @@ $$
 LANGUAGE plpgsql;
 `
 
+//pgSubstringSchema adds trigram indexes, which postgresql uses for LIKE
+//patterns that start with a wildcard
+const pgSubstringSchema = `
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS tuples_query_trgm ON tuples USING gin (query gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS tuples_answer_trgm ON tuples USING gin (answer gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS individual_value_trgm ON individual USING gin (value gin_trgm_ops);
+`
+
+//pgTimeArg converts times the same way Update does when storing them
+func pgTimeArg(b *sqlBuilder, t time.Time) string {
+	return b.arg(t) + "::timestamptz::timestamp"
+}
+
 type PGStore struct {
 	conn *sqlx.DB
 	*SQLCommonStore
@@ -118,7 +204,7 @@ func NewPGStore(uri string) (Store, error) {
 	if err != nil {
 		return nil, err
 	}
-	common := &SQLCommonStore{conn: conn}
+	common := &SQLCommonStore{conn: conn, timeArg: pgTimeArg, clientsUnion: "string_agg(clients, ''::bytea)"}
 	return &PGStore{conn: conn, SQLCommonStore: common}, nil
 }
 
@@ -126,8 +212,158 @@ func (s *PGStore) Close() error {
 	return s.Close()
 }
 
+//pgMigrateSchema are the functions migrate fills new columns of old rows
+//with. pdns_inet is NULL for anything that isn't an address instead of an
+//error.
+const pgMigrateSchema = `
+CREATE OR REPLACE FUNCTION pdns_inet(a text) RETURNS inet AS
+$$
+BEGIN
+    IF a !~ '^[0-9a-fA-F:.]+$' OR (a !~ ':' AND a !~ '^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$') THEN
+        RETURN NULL;
+    END IF;
+    RETURN a::inet;
+EXCEPTION WHEN invalid_text_representation THEN
+    RETURN NULL;
+END;
+$$
+LANGUAGE plpgsql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION pdns_answer_type(ty text, a text) RETURNS text AS
+$$
+    SELECT CASE
+        WHEN pdns_inet(a) IS NOT NULL AND strpos(a, ':') > 0 THEN 'AAAA'
+        WHEN pdns_inet(a) IS NOT NULL THEN 'A'
+        WHEN ty IN ('A', 'AAAA', 'A6') THEN 'CNAME'
+        ELSE ty
+    END
+$$
+LANGUAGE sql IMMUTABLE;
+`
+
+//pgColumn is a column added to a table after it was first released,
+//backfill sets it for the rows that were there before it
+type pgColumn struct {
+	table    string
+	name     string
+	def      string
+	backfill string
+}
+
+var pgColumns = []pgColumn{
+	{table: "tuples", name: "rrtype", def: "text",
+		backfill: "UPDATE tuples SET rrtype = pdns_answer_type(type, answer)"},
+	{table: "tuples", name: "clients", def: "bytea"},
+	{table: "individual", name: "clients", def: "bytea"},
+	{table: "tuples", name: "sensor", def: "text NOT NULL DEFAULT ''"},
+	{table: "individual", name: "sensor", def: "text NOT NULL DEFAULT ''"},
+	{table: "rcodes", name: "sensor", def: "text NOT NULL DEFAULT ''"},
+	{table: "filenames", name: "sensor", def: "text NOT NULL DEFAULT ''"},
+	{table: "tuples", name: "answer_ip", def: "inet",
+		backfill: "UPDATE tuples SET answer_ip = pdns_inet(answer) WHERE rrtype IN ('A', 'AAAA')"},
+	//The types isNameType in normalize.go lists
+	{table: "tuples", name: "answer_rev", def: "text NOT NULL DEFAULT ''",
+		backfill: "UPDATE tuples SET answer_rev = reverse(answer) WHERE rrtype IN ('CNAME', 'DNAME', 'NS', 'PTR', 'MX', 'SRV')"},
+	{table: "tuples", name: "original", def: "text"},
+	{table: "individual", name: "original", def: "text"},
+}
+
+//pgKeys are the primary keys in pgschema, tables created with another one
+//get theirs replaced
+var pgKeys = map[string][]string{
+	"tuples":     {"query", "type", "rrtype", "answer", "sensor"},
+	"individual": {"which", "value", "sensor"},
+	"rcodes":     {"query", "type", "rcode", "sensor"},
+	"filenames":  {"sensor", "filename"},
+}
+
+//migrate brings tables created by older versions up to date, it runs before
+//pgschema so the indexes on new columns can be created
+func (s *PGStore) migrate() error {
+	tx, err := s.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(pgMigrateSchema)
+	if err != nil {
+		return err
+	}
+	tableExists := func(table string) (bool, error) {
+		var exists bool
+		err := tx.Get(&exists, "SELECT to_regclass($1) IS NOT NULL", table)
+		return exists, err
+	}
+	for _, col := range pgColumns {
+		exists, err := tableExists(col.table)
+		if err != nil {
+			return err
+		}
+		var found int
+		err = tx.Get(&found, "SELECT count(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2", col.table, col.name)
+		if err != nil {
+			return err
+		}
+		if !exists || found > 0 {
+			continue
+		}
+		log.Printf("Adding the %s column to %s", col.name, col.table)
+		_, err = tx.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.name + " " + col.def)
+		if err != nil {
+			return err
+		}
+		if col.backfill != "" {
+			_, err = tx.Exec(col.backfill)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for table, key := range pgKeys {
+		exists, err := tableExists(table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		var cols []string
+		err = tx.Select(&cols, "SELECT a.attname FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey) WHERE i.indrelid = $1::regclass AND i.indisprimary ORDER BY a.attname", table)
+		if err != nil {
+			return err
+		}
+		sorted := append([]string(nil), key...)
+		sort.Strings(sorted)
+		if strings.Join(cols, ",") == strings.Join(sorted, ",") {
+			continue
+		}
+		log.Printf("Changing the primary key of %s to (%s)", table, strings.Join(key, ", "))
+		//Unique constraints on the old key would still be enforced
+		var constraints []string
+		err = tx.Select(&constraints, "SELECT conname FROM pg_constraint WHERE conrelid = $1::regclass AND contype IN ('p', 'u')", table)
+		if err != nil {
+			return err
+		}
+		for _, name := range constraints {
+			_, err = tx.Exec("ALTER TABLE " + table + " DROP CONSTRAINT " + pq.QuoteIdentifier(name))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD PRIMARY KEY (" + strings.Join(key, ", ") + ")")
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (s *PGStore) Init() error {
-	_, err := s.conn.Exec(pgschema)
+	err := s.migrate()
+	if err != nil {
+		return fmt.Errorf("migrating the database: %w", err)
+	}
+	_, err = s.conn.Exec(pgschema)
 	// Ignore a duplicte table error message
 	if pqerr, ok := err.(*pq.Error); ok {
 		if pqerr.Code == "42P07" {
@@ -138,6 +374,98 @@ func (s *PGStore) Init() error {
 	return err
 }
 
+func (s *PGStore) InitSubstringIndex() error {
+	_, err := s.conn.Exec(pgSubstringSchema)
+	return err
+}
+
+//CIDRTuples finds the tuples with an address answer inside prefix
+func (s *PGStore) CIDRTuples(prefix string, opts SearchOptions) (tupleResults, error) {
+	lo, hi, err := ipRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	b := newSQLBuilder()
+	where := "answer_ip BETWEEN " + b.arg(lo.String()) + "::inet AND " + b.arg(hi.String()) + "::inet"
+	return s.searchTuples(b, where, opts)
+}
+
+//pgMergeSketch returns the union of a stored client sketch and new clients
+func pgMergeSketch(stored []byte, clients *hll) []byte {
+	h := parseHLL(stored)
+	if clients != nil {
+		h.merge(clients)
+	}
+	return h.bytes()
+}
+
+//pgTupleSketches returns the stored client sketches of the tuples in batch,
+//keyed by the tuple as it is stored. The rows are locked until the
+//transaction ends so nobody else updates them before the merged sketches
+//are written back.
+func pgTupleSketches(tx *sql.Tx, sensor string, batch []aggregatedTuple) (map[uniqueTuple][]byte, error) {
+	var queries, qtypes, rrtypes, answers []string
+	for _, q := range batch {
+		queries = append(queries, Reverse(q.query))
+		qtypes = append(qtypes, q.qtype)
+		rrtypes = append(rrtypes, q.rrtype)
+		answers = append(answers, q.answer)
+	}
+	rows, err := tx.Query(`SELECT query, type, rrtype, answer, clients FROM tuples
+		WHERE sensor = $1 AND (query, type, rrtype, answer) IN (SELECT * FROM unnest($2::text[], $3::text[], $4::text[], $5::text[]))
+		FOR UPDATE`, sensor, pq.Array(queries), pq.Array(qtypes), pq.Array(rrtypes), pq.Array(answers))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sketches := make(map[uniqueTuple][]byte)
+	for rows.Next() {
+		var key uniqueTuple
+		var clients []byte
+		err = rows.Scan(&key.query, &key.qtype, &key.rrtype, &key.answer, &clients)
+		if err != nil {
+			return nil, err
+		}
+		sketches[key] = clients
+	}
+	return sketches, rows.Err()
+}
+
+//pgIndividualValue is value as it is stored, queries are reversed
+func pgIndividualValue(q uniqueIndividual) string {
+	if q.which == "Q" {
+		return Reverse(q.value)
+	}
+	return q.value
+}
+
+//pgIndividualSketches is pgTupleSketches for individual values
+func pgIndividualSketches(tx *sql.Tx, sensor string, batch []aggregatedIndividual) (map[uniqueIndividual][]byte, error) {
+	var values, which []string
+	for _, q := range batch {
+		values = append(values, pgIndividualValue(q.uniqueIndividual))
+		which = append(which, q.which)
+	}
+	rows, err := tx.Query(`SELECT value, which, clients FROM individual
+		WHERE sensor = $1 AND (value, which) IN (SELECT * FROM unnest($2::text[], $3::text[]))
+		FOR UPDATE`, sensor, pq.Array(values), pq.Array(which))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sketches := make(map[uniqueIndividual][]byte)
+	for rows.Next() {
+		var key uniqueIndividual
+		var clients []byte
+		err = rows.Scan(&key.value, &key.which, &clients)
+		if err != nil {
+			return nil, err
+		}
+		sketches[key] = clients
+	}
+	return sketches, rows.Err()
+}
+
 func genFullBatchSelect(tmpl string, batchSize int) string {
 	var queries []string
 	numParams := strings.Count(tmpl, "$")
@@ -164,40 +492,50 @@ func (s *PGStore) Update(ar aggregationResult) (UpdateResult, error) {
 	if err != nil {
 		return result, err
 	}
-	//Setup the 2 different prepared statements
-	updateTupleTmpl := "update_tuples($%d, $%d, $%d, $%d, $%d, to_timestamp($%d)::timestamp, to_timestamp($%d)::timestamp)"
+	//Setup the 3 different prepared statements
+	updateTupleTmpl := "update_tuples($%d, $%d, $%d, $%d, $%d, $%d, $%d::timestamptz::timestamp, $%d::timestamptz::timestamp, $%d, $%d, $%d)"
 	updateTupleBatch, err := tx.Prepare(genFullBatchSelect(updateTupleTmpl, BATCHSIZE))
 	if err != nil {
 		return result, err
 	}
 	defer updateTupleBatch.Close()
 
-	updateIndividualTmpl := "update_individual($%d, $%d, $%d, to_timestamp($%d)::timestamp, to_timestamp($%d)::timestamp)"
+	updateIndividualTmpl := "update_individual($%d, $%d, $%d, $%d::timestamptz::timestamp, $%d::timestamptz::timestamp, $%d, $%d, $%d)"
 	updateIndividualeBatch, err := tx.Prepare(genFullBatchSelect(updateIndividualTmpl, BATCHSIZE))
 	if err != nil {
 		return result, err
 	}
 	defer updateIndividualeBatch.Close()
 
+	updateRcodeTmpl := "update_rcodes($%d, $%d, $%d, $%d, $%d::timestamptz::timestamp, $%d::timestamptz::timestamp, $%d)"
+	updateRcodeBatch, err := tx.Prepare(genFullBatchSelect(updateRcodeTmpl, BATCHSIZE))
+	if err != nil {
+		return result, err
+	}
+	defer updateRcodeBatch.Close()
+
 	var arguments []interface{}
 	batchCounter := 0
 
-	runBatch := func(tmpl string, preparedBatch *sql.Stmt, arguments []interface{}, batchSize int) {
+	runBatch := func(tmpl string, preparedBatch *sql.Stmt, arguments []interface{}, batchSize int) error {
 		if batchSize == 0 {
-			return
+			return nil
 		}
 		var stmt *sql.Stmt
 		if batchSize == BATCHSIZE {
 			stmt = preparedBatch
 		} else {
 			stmt, err = tx.Prepare(genFullBatchSelect(tmpl, batchSize))
+			if err != nil {
+				return err
+			}
 			defer stmt.Close()
 		}
 		res, err := stmt.Query(arguments...)
 		//log.Printf("Fullq is: %s", fullq)
 		//log.Printf("Arguments is: %#v", arguments)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		res.Next()
 		var update_result string
@@ -210,37 +548,67 @@ func (s *PGStore) Update(ar aggregationResult) (UpdateResult, error) {
 				result.Updated++
 			}
 		}
+		return res.Err()
 	}
 
 	// Ok, now let's update stuff
-	for _, q := range ar.Tuples {
-		//Update the tuples table
-		query := Reverse(q.query)
-		arguments = append(arguments, query, q.qtype, q.answer, q.ttl, q.count, ToTS(q.first), ToTS(q.last))
-		batchCounter++
-		if batchCounter == BATCHSIZE {
-			runBatch(updateTupleTmpl, updateTupleBatch, arguments, batchCounter)
-			arguments = arguments[:0]
-			batchCounter = 0
+	for start := 0; start < len(ar.Tuples); start += BATCHSIZE {
+		batch := ar.Tuples[start:]
+		if len(batch) > BATCHSIZE {
+			batch = batch[:BATCHSIZE]
+		}
+		sketches, err := pgTupleSketches(tx, ar.Sensor, batch)
+		if err != nil {
+			return result, err
+		}
+		for _, q := range batch {
+			query := Reverse(q.query)
+			key := uniqueTuple{query: query, qtype: q.qtype, rrtype: q.rrtype, answer: q.answer}
+			clients := pgMergeSketch(sketches[key], q.clients)
+			arguments = append(arguments, query, q.qtype, q.rrtype, q.answer, q.ttl, q.count, q.first, q.last, clients, ar.Sensor, sqlOriginal(q.original))
 		}
+		err = runBatch(updateTupleTmpl, updateTupleBatch, arguments, len(batch))
+		if err != nil {
+			return result, err
+		}
+		arguments = arguments[:0]
 	}
-	runBatch(updateTupleTmpl, updateTupleBatch, arguments, batchCounter)
-	arguments = arguments[:0]
-	batchCounter = 0
-	for _, q := range ar.Individual {
-		value := q.value
-		if q.which == "Q" {
-			value = Reverse(value)
+	for start := 0; start < len(ar.Individual); start += BATCHSIZE {
+		batch := ar.Individual[start:]
+		if len(batch) > BATCHSIZE {
+			batch = batch[:BATCHSIZE]
+		}
+		sketches, err := pgIndividualSketches(tx, ar.Sensor, batch)
+		if err != nil {
+			return result, err
 		}
-		arguments = append(arguments, q.which, value, q.count, ToTS(q.first), ToTS(q.last))
+		for _, q := range batch {
+			key := uniqueIndividual{value: pgIndividualValue(q.uniqueIndividual), which: q.which}
+			clients := pgMergeSketch(sketches[key], q.clients)
+			arguments = append(arguments, q.which, key.value, q.count, q.first, q.last, clients, ar.Sensor, sqlOriginal(q.original))
+		}
+		err = runBatch(updateIndividualTmpl, updateIndividualeBatch, arguments, len(batch))
+		if err != nil {
+			return result, err
+		}
+		arguments = arguments[:0]
+	}
+	for _, q := range ar.Rcodes {
+		arguments = append(arguments, Reverse(q.query), q.qtype, q.rcode, q.count, q.first, q.last, ar.Sensor)
 		batchCounter++
 		if batchCounter == BATCHSIZE {
-			runBatch(updateIndividualTmpl, updateIndividualeBatch, arguments, batchCounter)
+			err = runBatch(updateRcodeTmpl, updateRcodeBatch, arguments, batchCounter)
+			if err != nil {
+				return result, err
+			}
 			arguments = arguments[:0]
 			batchCounter = 0
 		}
 	}
-	runBatch(updateIndividualTmpl, updateIndividualeBatch, arguments, batchCounter)
+	err = runBatch(updateRcodeTmpl, updateRcodeBatch, arguments, batchCounter)
+	if err != nil {
+		return result, err
+	}
 	result.Duration = time.Since(start)
 	return result, s.Commit()
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -16,14 +18,34 @@ func Reverse(s string) string {
 	return string(runes)
 }
 
+//The clients columns hold HLL sketches, they are read as client_sketch and
+//turned back into the estimated number of distinct clients after the query
+const tupleColumns = "query, type, rrtype, answer, count, clients AS client_sketch, ttl, first, last, coalesce(original, '') AS original"
+const individualColumns = "which, value, count, clients AS client_sketch, first, last, coalesce(original, '') AS original"
+
+//sqlOriginal is the original spelling of a name, NULL while it was always
+//logged normalized so the first one that wasn't is kept
+func sqlOriginal(original string) interface{} {
+	if original == "" {
+		return nil
+	}
+	return original
+}
+
 type SQLCommonStore struct {
 	conn    *sqlx.DB
 	tx      *sql.Tx
 	txDepth int
+	//timeArg adds a time to a search in the form the first and last
+	//columns can be compared with
+	timeArg func(*sqlBuilder, time.Time) string
+	//clientsUnion is the aggregate that merges the client sketches of the
+	//rows of a sensor merged search
+	clientsUnion string
 }
 
 func (s *SQLCommonStore) Clear() error {
-	_, err := s.conn.Exec("DELETE FROM filenames;DELETE FROM individual;DELETE FROM tuples;")
+	_, err := s.conn.Exec("DELETE FROM filenames;DELETE FROM individual;DELETE FROM tuples;DELETE FROM rcodes;")
 	return err
 }
 func (s *SQLCommonStore) Begin() error {
@@ -61,14 +83,26 @@ func (s *SQLCommonStore) Commit() error {
 	return err
 }
 
-func (s *SQLCommonStore) IsLogIndexed(filename string) (bool, error) {
+//Rollback aborts the current transaction, no matter how deeply Begin was
+//nested, so the store is usable again after an error part way through
+func (s *SQLCommonStore) Rollback() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	s.txDepth = 0
+	return err
+}
+
+func (s *SQLCommonStore) IsLogIndexed(sensor string, filename string) (bool, error) {
 	tx, err := s.BeginTx()
 	if err != nil {
 		return false, err
 	}
 	defer s.Commit()
 	var fn string
-	err = tx.QueryRow("SELECT filename FROM filenames WHERE filename=$1", filename).Scan(&fn)
+	err = tx.QueryRow("SELECT filename FROM filenames WHERE sensor=$1 AND filename=$2", sensor, filename).Scan(&fn)
 	switch {
 	case err == sql.ErrNoRows:
 		return false, nil
@@ -79,28 +113,43 @@ func (s *SQLCommonStore) IsLogIndexed(filename string) (bool, error) {
 	}
 }
 
-func (s *SQLCommonStore) SetLogIndexed(filename string, ar aggregationResult, ur UpdateResult) error {
+func (s *SQLCommonStore) SetLogIndexed(sensor string, filename string, ar aggregationResult, ur UpdateResult) error {
 	tx, err := s.BeginTx()
 	defer s.Commit()
 	if err != nil {
 		return err
 	}
-	q := `INSERT INTO filenames (filename,
+	q := `INSERT INTO filenames (sensor, filename,
 	      aggregation_time, total_records, skipped_records, tuples, individual,
 	      store_time, inserted, updated)
-	      VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9)`
-	_, err = tx.Exec(q, filename,
+	      VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)`
+	_, err = tx.Exec(q, sensor, filename,
 		ar.Duration.Seconds(), ar.TotalRecords, ar.SkippedRecords, ar.TuplesLen, ar.IndividualLen,
 		ur.Duration.Seconds(), ur.Inserted, ur.Updated)
 	return err
 }
 
+//reversedAnswer is the answer reversed like queries are, for suffix
+//searches on answers. Only answers that are names have one.
+func reversedAnswer(rrtype string, answer string) string {
+	if !isNameType(rrtype) {
+		return ""
+	}
+	return Reverse(answer)
+}
+
 func reverseQuery(tr tupleResults) {
 	for idx, rec := range tr {
 		rec.Query = Reverse(rec.Query)
 		tr[idx] = rec
 	}
 }
+func reverseRcodeQuery(rr rcodeResults) {
+	for idx, rec := range rr {
+		rec.Query = Reverse(rec.Query)
+		rr[idx] = rec
+	}
+}
 func reverseValue(tr individualResults) {
 	for idx, rec := range tr {
 		if rec.Which == "Q" {
@@ -110,44 +159,464 @@ func reverseValue(tr individualResults) {
 	}
 }
 
-func (s *SQLCommonStore) FindQueryTuples(query string) (tupleResults, error) {
-	tr := []tupleResult{}
-	query = Reverse(query)
-	err := s.conn.Select(&tr, "SELECT * FROM tuples WHERE query = $1", query)
-	reverseQuery(tr)
-	return tr, err
+//sqlBuilder collects the arguments of a query while it is being put
+//together. postgresql and sqlite use numbered placeholders and clickhouse
+//uses ?, either way arguments have to be added in the order they appear.
+type sqlBuilder struct {
+	args     []interface{}
+	numbered bool
+	//likeEscape adds an ESCAPE clause to LIKE, sqlite has no default
+	//escape character while clickhouse doesn't support the clause at all
+	likeEscape bool
 }
-func (s *SQLCommonStore) FindTuples(query string) (tupleResults, error) {
-	tr := []tupleResult{}
-	rquery := Reverse(query)
-	err := s.conn.Select(&tr, "SELECT * FROM tuples WHERE query = $1 OR answer = $2 ORDER BY query, answer", rquery, query)
-	reverseQuery(tr)
 
-	return tr, err
+func newSQLBuilder() *sqlBuilder {
+	return &sqlBuilder{numbered: true, likeEscape: true}
+}
+
+func (b *sqlBuilder) arg(v interface{}) string {
+	b.args = append(b.args, v)
+	if b.numbered {
+		return fmt.Sprintf("$%d", len(b.args))
+	}
+	return "?"
+}
+
+//like matches column against a LIKE pattern where \ escapes wildcards
+func (b *sqlBuilder) like(column string, pattern string) string {
+	cond := column + " like " + b.arg(pattern)
+	if b.likeEscape {
+		cond += ` ESCAPE '\'`
+	}
+	return cond
+}
+
+//prefix matches column against anything starting with a literal string
+func (b *sqlBuilder) prefix(column string, prefix string) string {
+	return b.like(column, escapeLike(prefix)+"%")
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+//escapeLike escapes the LIKE wildcards in s, _ is common in names
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+//globToLike turns a shell style glob, with * and ?, into a LIKE pattern
+func globToLike(glob string) string {
+	var sb strings.Builder
+	for _, c := range glob {
+		switch c {
+		case '*':
+			sb.WriteByte('%')
+		case '?':
+			sb.WriteByte('_')
+		default:
+			sb.WriteString(escapeLike(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+//hasLiteralPrefix is true when a glob doesn't start with a wildcard, so a
+//LIKE made from it can use an index
+func hasLiteralPrefix(glob string) bool {
+	return glob != "" && glob[0] != '*' && glob[0] != '?'
+}
+
+//filter adds the conditions from opts to a search
+func (b *sqlBuilder) filter(where string, opts SearchOptions) string {
+	where = "(" + where + ")"
+	if opts.Sensor != "" {
+		where += " AND sensor = " + b.arg(opts.Sensor)
+	}
+	return where
+}
+
+//rrtypes adds the answer types from opts to a tuple search
+func (b *sqlBuilder) rrtypes(where string, opts SearchOptions) string {
+	if len(opts.RRTypes) == 0 {
+		return where
+	}
+	var args []string
+	for _, rrtype := range opts.RRTypes {
+		args = append(args, b.arg(strings.ToUpper(rrtype)))
+	}
+	return where + " AND rrtype IN (" + strings.Join(args, ", ") + ")"
+}
+
+//Every sensor has its own rows. Unless they were asked for separately they
+//are merged into one, the same as if everything came from a single sensor.
+const tupleMergedColumns = "query, type, rrtype, answer, sum(count) AS count, %s AS client_sketch, max(ttl) AS ttl, min(first) AS first, max(last) AS last, coalesce(min(original), '') AS original"
+const individualMergedColumns = "which, value, sum(count) AS count, %s AS client_sketch, min(first) AS first, max(last) AS last, coalesce(min(original), '') AS original"
+const rcodeColumns = "query, type, rcode, count, first, last"
+const rcodeMergedColumns = "query, type, rcode, sum(count) AS count, min(first) AS first, max(last) AS last"
+
+//orderBy returns the ORDER BY for a search, once its options are checked.
+//name is the columns records are sorted by by default, they also break
+//ties in the other orders.
+func orderBy(opts SearchOptions, name string) (string, error) {
+	if err := opts.check(); err != nil {
+		return "", err
+	}
+	if opts.perSensor() {
+		name += ", sensor"
+	}
+	key := strings.TrimPrefix(opts.Sort, "-")
+	desc := ""
+	if key != opts.Sort {
+		desc = " DESC"
+	}
+	switch key {
+	case "count", "first", "last":
+		return " ORDER BY " + key + desc + ", " + name, nil
+	}
+	if desc != "" {
+		name = strings.ReplaceAll(name, ",", desc+",") + desc
+	}
+	return " ORDER BY " + name, nil
+}
+
+//limit returns the LIMIT for a search, if it has one
+func limit(opts SearchOptions) string {
+	if opts.Limit == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", opts.Limit, opts.Offset)
+}
+
+//fenced adds the time fences to the conditions of a search with a row per
+//sensor. When sensors are merged they are checked by having instead,
+//against the merged times.
+func (s *SQLCommonStore) fenced(b *sqlBuilder, where string, opts SearchOptions) string {
+	if fences := timeFences(b, "first", "last", opts, s.timeArg); fences != "" {
+		return where + " AND " + fences
+	}
+	return where
+}
+func (s *SQLCommonStore) having(b *sqlBuilder, opts SearchOptions) string {
+	if fences := timeFences(b, "min(first)", "max(last)", opts, s.timeArg); fences != "" {
+		return " HAVING " + fences
+	}
+	return ""
+}
+
+func (s *SQLCommonStore) tuplesQuery(b *sqlBuilder, where string, opts SearchOptions) (string, error) {
+	where = b.rrtypes(b.filter(where, opts), opts)
+	var q string
+	if opts.perSensor() {
+		q = "SELECT sensor, " + tupleColumns + " FROM tuples WHERE " + s.fenced(b, where, opts)
+	} else {
+		q = "SELECT " + fmt.Sprintf(tupleMergedColumns, s.clientsUnion) + " FROM tuples WHERE " + where + " GROUP BY query, type, rrtype, answer" + s.having(b, opts)
+	}
+	order, err := orderBy(opts, "query, answer")
+	return q + order + limit(opts), err
+}
+
+//sqlTuple and sqlIndividual are the rows of a search, before the client
+//sketch is turned into the number of clients
+type sqlTuple struct {
+	tupleResult
+	ClientSketch []byte `db:"client_sketch"`
 }
-func (s *SQLCommonStore) LikeTuples(query string) (tupleResults, error) {
+
+func (row sqlTuple) result() tupleResult {
+	tr := row.tupleResult
+	tr.Clients = uint(parseHLL(row.ClientSketch).estimate())
+	return tr
+}
+
+type sqlIndividual struct {
+	individualResult
+	ClientSketch []byte `db:"client_sketch"`
+}
+
+func (row sqlIndividual) result() individualResult {
+	ir := row.individualResult
+	ir.Clients = uint(parseHLL(row.ClientSketch).estimate())
+	return ir
+}
+
+func (s *SQLCommonStore) searchTuples(b *sqlBuilder, where string, opts SearchOptions) (tupleResults, error) {
 	tr := []tupleResult{}
-	rquery := Reverse(query)
-	err := s.conn.Select(&tr, "SELECT * FROM tuples WHERE query like $1 OR answer like $2 ORDER BY query, answer", rquery+"%", query+"%")
+	q, err := s.tuplesQuery(b, where, opts)
+	if err != nil {
+		return tr, err
+	}
+	var rows []sqlTuple
+	err = s.conn.Select(&rows, q, b.args...)
+	for _, row := range rows {
+		tr = append(tr, row.result())
+	}
 	reverseQuery(tr)
 	return tr, err
 }
-func (s *SQLCommonStore) FindIndividual(value string) (individualResults, error) {
-	rvalue := Reverse(value)
-	tr := []individualResult{}
-	err := s.conn.Select(&tr, "SELECT * FROM individual WHERE (which='A' AND value = $1) OR (which='Q' AND value = $2) ORDER BY value", value, rvalue)
-	reverseValue(tr)
-	return tr, err
+
+//ExportTuples calls fn with every tuple in the store, or every one opts
+//lets through, as they are read instead of collecting them first
+func (s *SQLCommonStore) ExportTuples(opts SearchOptions, fn func(tupleResult) error) error {
+	b := newSQLBuilder()
+	q, err := s.tuplesQuery(b, "1=1", opts)
+	if err != nil {
+		return err
+	}
+	return eachTuple(s.conn, q, b.args, fn)
 }
 
-func (s *SQLCommonStore) LikeIndividual(value string) (individualResults, error) {
-	rvalue := Reverse(value)
+//eachTuple runs a tuple query and calls fn with every row as it is read
+func eachTuple(conn *sqlx.DB, q string, args []interface{}, fn func(tupleResult) error) error {
+	rows, err := conn.Queryx(q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row sqlTuple
+		err = rows.StructScan(&row)
+		if err != nil {
+			return err
+		}
+		tr := row.result()
+		tr.Query = Reverse(tr.Query)
+		err = fn(tr)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLCommonStore) searchIndividual(b *sqlBuilder, where string, opts SearchOptions) (individualResults, error) {
 	tr := []individualResult{}
-	err := s.conn.Select(&tr, "SELECT * FROM individual WHERE (which='A' AND value like $1) OR (which='Q' AND value like $2) ORDER BY value", value+"%", rvalue+"%")
+	where = b.filter(where, opts)
+	var q string
+	if opts.perSensor() {
+		q = "SELECT sensor, " + individualColumns + " FROM individual WHERE " + s.fenced(b, where, opts)
+	} else {
+		q = "SELECT " + fmt.Sprintf(individualMergedColumns, s.clientsUnion) + " FROM individual WHERE " + where + " GROUP BY which, value" + s.having(b, opts)
+	}
+	order, err := orderBy(opts, "value")
+	if err != nil {
+		return tr, err
+	}
+	var rows []sqlIndividual
+	err = s.conn.Select(&rows, q+order+limit(opts), b.args...)
+	for _, row := range rows {
+		tr = append(tr, row.result())
+	}
 	reverseValue(tr)
 	return tr, err
 }
 
+func (s *SQLCommonStore) searchRcodes(b *sqlBuilder, where string, opts SearchOptions) (rcodeResults, error) {
+	rr := []rcodeResult{}
+	where = b.filter(where, opts)
+	var q string
+	if opts.perSensor() {
+		q = "SELECT sensor, " + rcodeColumns + " FROM rcodes WHERE " + s.fenced(b, where, opts)
+	} else {
+		q = "SELECT " + rcodeMergedColumns + " FROM rcodes WHERE " + where + " GROUP BY query, type, rcode" + s.having(b, opts)
+	}
+	order, err := orderBy(opts, "query, type, rcode")
+	if err != nil {
+		return rr, err
+	}
+	err = s.conn.Select(&rr, q+order+limit(opts), b.args...)
+	reverseRcodeQuery(rr)
+	return rr, err
+}
+
+//The conditions of every search, shared by all the stores. Search input is
+//normalized the same way names are when they are indexed. Answers that
+//aren't names, like TXT records, are stored as they were logged so they
+//are also matched as given.
+
+func queryTuplesWhere(b *sqlBuilder, query string) string {
+	return "query = " + b.arg(Reverse(normalizeName(query)))
+}
+func tuplesWhere(b *sqlBuilder, query string) string {
+	name := normalizeName(query)
+	return "query = " + b.arg(Reverse(name)) + " OR answer IN (" + b.arg(name) + ", " + b.arg(query) + ")"
+}
+func likeTuplesWhere(b *sqlBuilder, query string, opts SearchOptions) string {
+	name := normalizeName(query)
+	if opts.RawPrefix {
+		return b.prefix("query", Reverse(name)) + " OR " + b.prefix("answer", name) + " OR " + b.prefix("answer", query)
+	}
+	return subdomainWhere(b, "query", Reverse(name)) + " OR " + answerPrefixWhere(b, "answer", name)
+}
+func likeAnswersWhere(b *sqlBuilder, name string, opts SearchOptions) string {
+	rname := Reverse(normalizeName(name))
+	if opts.RawPrefix {
+		return b.prefix("answer_rev", rname)
+	}
+	return subdomainWhere(b, "answer_rev", rname)
+}
+
+//globTuplesWhere matches query names through their reversed form, which
+//can use the index when the glob starts with a wildcard, as in
+//"*.corp.example.com". Names in answers are stored both ways, so whichever
+//end of the glob is literal is used. A glob with wildcards at both ends
+//has to scan either way.
+func globTuplesWhere(b *sqlBuilder, pattern string) string {
+	glob := normalizeName(pattern)
+	rglob := Reverse(glob)
+	where := b.like("query", globToLike(rglob))
+	if !hasLiteralPrefix(glob) && hasLiteralPrefix(rglob) {
+		return where + " OR " + b.like("answer_rev", globToLike(rglob))
+	}
+	return where + " OR " + b.like("answer", globToLike(glob))
+}
+
+//globQueryTuplesWhere only matches query names. A glob without wildcards
+//is an exact match.
+func globQueryTuplesWhere(b *sqlBuilder, pattern string) string {
+	return b.like("query", globToLike(Reverse(normalizeName(pattern))))
+}
+
+//globAnswersWhere only matches answers that are names, through whichever
+//end of the glob is literal like globTuplesWhere
+func globAnswersWhere(b *sqlBuilder, pattern string) string {
+	glob := normalizeName(pattern)
+	rglob := Reverse(glob)
+	if !hasLiteralPrefix(glob) && hasLiteralPrefix(rglob) {
+		return b.like("answer_rev", globToLike(rglob))
+	}
+	return "answer_rev != '' AND " + b.like("answer", globToLike(glob))
+}
+func globIndividualWhere(b *sqlBuilder, pattern string) string {
+	glob := normalizeName(pattern)
+	return "(which='A' AND " + b.like("value", globToLike(glob)) + ") OR (which='Q' AND " + b.like("value", globToLike(Reverse(glob))) + ")"
+}
+
+//containsTuplesWhere matches a substring anywhere in a name. Part of a name
+//can't be normalized like a whole one so it is only lower cased, answers
+//that aren't names are also matched as given.
+func containsTuplesWhere(b *sqlBuilder, substring string) string {
+	sub := strings.ToLower(substring)
+	where := b.like("query", containsPattern(Reverse(sub))) + " OR " + b.like("answer", containsPattern(sub))
+	if sub != substring {
+		where += " OR " + b.like("answer", containsPattern(substring))
+	}
+	return where
+}
+func containsIndividualWhere(b *sqlBuilder, substring string) string {
+	sub := strings.ToLower(substring)
+	answer := b.like("value", containsPattern(sub))
+	if sub != substring {
+		answer += " OR " + b.like("value", containsPattern(substring))
+	}
+	return "(which='A' AND (" + answer + ")) OR (which='Q' AND " + b.like("value", containsPattern(Reverse(sub))) + ")"
+}
+
+//containsPattern is a LIKE pattern matching s anywhere in a value
+func containsPattern(s string) string {
+	return "%" + escapeLike(s) + "%"
+}
+
+func individualWhere(b *sqlBuilder, value string) string {
+	name := normalizeName(value)
+	return "(which='A' AND value IN (" + b.arg(name) + ", " + b.arg(value) + ")) OR (which='Q' AND value = " + b.arg(Reverse(name)) + ")"
+}
+func likeIndividualWhere(b *sqlBuilder, value string, opts SearchOptions) string {
+	name := normalizeName(value)
+	if opts.RawPrefix {
+		return "(which='A' AND (" + b.prefix("value", name) + " OR " + b.prefix("value", value) + ")) OR (which='Q' AND " + b.prefix("value", Reverse(name)) + ")"
+	}
+	return "(which='A' AND (" + answerPrefixWhere(b, "value", name) + ")) OR (which='Q' AND (" + subdomainWhere(b, "value", Reverse(name)) + "))"
+}
+func rcodesWhere(b *sqlBuilder, query string) string {
+	return "query = " + b.arg(Reverse(normalizeName(query)))
+}
+func likeRcodesWhere(b *sqlBuilder, query string, opts SearchOptions) string {
+	rname := Reverse(normalizeName(query))
+	if opts.RawPrefix {
+		return b.prefix("query", rname)
+	}
+	return subdomainWhere(b, "query", rname)
+}
+
+//subdomainWhere matches a reversed name and every name below it, but only
+//at a label boundary so google.com doesn't match evilgoogle.com. Both are
+//prefix matches so the index on the reversed column can be used.
+func subdomainWhere(b *sqlBuilder, column string, rname string) string {
+	return column + " = " + b.arg(rname) + " OR " + b.prefix(column, rname+".")
+}
+
+//answerPrefixWhere is the same for answers, which aren't reversed. That
+//makes it a match on whole octets for addresses, 10.1 matches 10.1.2.3
+//but not 10.10.2.3.
+func answerPrefixWhere(b *sqlBuilder, column string, value string) string {
+	return column + " = " + b.arg(value) + " OR " + b.prefix(column, value+".") + " OR " + b.prefix(column, value+":")
+}
+
+func (s *SQLCommonStore) FindQueryTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, queryTuplesWhere(b, query), opts)
+}
+func (s *SQLCommonStore) FindTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, tuplesWhere(b, query), opts)
+}
+func (s *SQLCommonStore) LikeTuples(query string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, likeTuplesWhere(b, query, opts), opts)
+}
+func (s *SQLCommonStore) LikeAnswers(name string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, likeAnswersWhere(b, name, opts), opts)
+}
+func (s *SQLCommonStore) GlobTuples(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, globTuplesWhere(b, pattern), opts)
+}
+func (s *SQLCommonStore) ContainsTuples(substring string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, containsTuplesWhere(b, substring), opts)
+}
+func (s *SQLCommonStore) GlobQueryTuples(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, globQueryTuplesWhere(b, pattern), opts)
+}
+func (s *SQLCommonStore) GlobAnswers(pattern string, opts SearchOptions) (tupleResults, error) {
+	b := newSQLBuilder()
+	return s.searchTuples(b, globAnswersWhere(b, pattern), opts)
+}
+func (s *SQLCommonStore) FindIndividual(value string, opts SearchOptions) (individualResults, error) {
+	b := newSQLBuilder()
+	return s.searchIndividual(b, individualWhere(b, value), opts)
+}
+
+func (s *SQLCommonStore) LikeIndividual(value string, opts SearchOptions) (individualResults, error) {
+	b := newSQLBuilder()
+	return s.searchIndividual(b, likeIndividualWhere(b, value, opts), opts)
+}
+
+func (s *SQLCommonStore) GlobIndividual(pattern string, opts SearchOptions) (individualResults, error) {
+	b := newSQLBuilder()
+	return s.searchIndividual(b, globIndividualWhere(b, pattern), opts)
+}
+
+func (s *SQLCommonStore) ContainsIndividual(substring string, opts SearchOptions) (individualResults, error) {
+	b := newSQLBuilder()
+	return s.searchIndividual(b, containsIndividualWhere(b, substring), opts)
+}
+
+func (s *SQLCommonStore) FindRcodes(query string, opts SearchOptions) (rcodeResults, error) {
+	b := newSQLBuilder()
+	return s.searchRcodes(b, rcodesWhere(b, query), opts)
+}
+
+func (s *SQLCommonStore) LikeRcodes(query string, opts SearchOptions) (rcodeResults, error) {
+	b := newSQLBuilder()
+	return s.searchRcodes(b, likeRcodesWhere(b, query, opts), opts)
+}
+
 //DeleteOld Deletes records that haven't been seen in DAYS, returns the total records deleted
 func (s *SQLCommonStore) DeleteOld(days int64) (int64, error) {
 	var deletedRows int64
@@ -168,5 +637,15 @@ func (s *SQLCommonStore) DeleteOld(days int64) (int64, error) {
 	}
 	rows, err = res.RowsAffected()
 	deletedRows += rows
+	if err != nil {
+		return deletedRows, err
+	}
+
+	res, err = s.conn.Exec("DELETE FROM rcodes WHERE last < $1", cutoff)
+	if err != nil {
+		return deletedRows, err
+	}
+	rows, err = res.RowsAffected()
+	deletedRows += rows
 	return deletedRows, err
 }
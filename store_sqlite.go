@@ -1,42 +1,73 @@
 package main
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 const schema = `
 CREATE TABLE IF NOT EXISTS tuples (
+	sensor character varying NOT NULL DEFAULT '',
 	query character varying,
 	type character varying,
+	rrtype character varying,
 	answer character varying,
+	answer_ip BLOB,
+	answer_rev character varying NOT NULL DEFAULT '',
 	count integer,
+	clients BLOB,
 	ttl integer,
 	first REAL,
 	last REAL,
-	PRIMARY KEY (query, type, answer)
+	original character varying,
+	PRIMARY KEY (query, type, rrtype, answer, sensor)
 ) ;
 CREATE INDEX IF NOT EXISTS tuples_query ON tuples(query);
 CREATE INDEX IF NOT EXISTS tuples_answer ON tuples(answer);
+CREATE INDEX IF NOT EXISTS tuples_answer_ip ON tuples(answer_ip);
+CREATE INDEX IF NOT EXISTS tuples_answer_rev ON tuples(answer_rev);
 CREATE INDEX IF NOT EXISTS tuples_first ON tuples(first);
 CREATE INDEX IF NOT EXISTS tuples_last ON tuples(last);
 
 CREATE TABLE IF NOT EXISTS individual (
+	sensor character varying NOT NULL DEFAULT '',
 	which char(1),
 	value character varying,
 	count integer,
+	clients BLOB,
 	first REAL,
 	last REAL,
-	PRIMARY KEY (which, value)
+	original character varying,
+	PRIMARY KEY (which, value, sensor)
 );
 CREATE INDEX IF NOT EXISTS individual_first ON individual(first);
 CREATE INDEX IF NOT EXISTS individual_last ON individual(last);
 
+CREATE TABLE IF NOT EXISTS rcodes (
+	sensor character varying NOT NULL DEFAULT '',
+	query character varying,
+	type character varying,
+	rcode character varying,
+	count integer,
+	first REAL,
+	last REAL,
+	PRIMARY KEY (query, type, rcode, sensor)
+);
+CREATE INDEX IF NOT EXISTS rcodes_rcode ON rcodes(rcode);
+CREATE INDEX IF NOT EXISTS rcodes_last ON rcodes(last);
+
 CREATE TABLE IF NOT EXISTS filenames (
-	filename character varying PRIMARY KEY UNIQUE NOT NULL,
+	sensor character varying NOT NULL DEFAULT '',
+	filename character varying NOT NULL,
 	time REAL DEFAULT (datetime('now', 'localtime')),
 	aggregation_time real,
 	total_records int,
@@ -45,7 +76,8 @@ CREATE TABLE IF NOT EXISTS filenames (
 	individual int,
 	store_time real,
 	inserted int,
-	updated int
+	updated int,
+	PRIMARY KEY (sensor, filename)
 );
 PRAGMA case_sensitive_like=ON;
 -- PRAGMA journal_mode=WAL;
@@ -54,17 +86,90 @@ PRAGMA temp_store = MEMORY;
 PRAGMA cache_size = 5000;
 `
 
+//sqliteSubstringSchema indexes every individual value in an FTS5 trigram
+//table that triggers keep up to date. Tuples are searched through it too,
+//every answer is also an individual value and so is every query, either as
+//a query or, for the owners in a CNAME chain, as an answer.
+const sqliteSubstringSchema = `
+CREATE VIRTUAL TABLE individual_trigram USING fts5(value, content='individual', tokenize='trigram');
+CREATE TRIGGER individual_trigram_insert AFTER INSERT ON individual BEGIN
+	INSERT INTO individual_trigram(rowid, value) VALUES (new.rowid, new.value);
+END;
+CREATE TRIGGER individual_trigram_delete AFTER DELETE ON individual BEGIN
+	INSERT INTO individual_trigram(individual_trigram, rowid, value) VALUES ('delete', old.rowid, old.value);
+END;
+INSERT INTO individual_trigram(individual_trigram) VALUES ('rebuild');
+`
+
+//sqliteTimeFormat matches what datetime() produces, plus microseconds, so
+//values still compare correctly as text against rows from older versions
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func sqliteTimeArg(b *sqlBuilder, t time.Time) string {
+	return b.arg(sqliteTime(t))
+}
+
+//sqliteIP stores addresses as 16 byte blobs, which sort the same as the
+//addresses themselves so a range is a BETWEEN
+func sqliteIP(ip net.IP) interface{} {
+	if ip == nil {
+		return nil
+	}
+	return []byte(ip)
+}
+
+//The sqlite driver is registered under another name so every connection
+//gets the functions for merging and counting client sketches, the ones
+//migrate fills new columns of old rows with, and pdns_reverse for contains
+//searches
+func init() {
+	sql.Register("sqlite3_pdns", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("hll_union", hllUnion, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterAggregator("hll_union_agg", newHLLAggregator, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterFunc("hll_count", hllCount, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterFunc("pdns_answer_type", sqliteAnswerType, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterFunc("pdns_answer_ip", sqliteAnswerIP, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterFunc("pdns_answer_rev", reversedAnswer, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterFunc("pdns_reverse", Reverse, true)
+		},
+	})
+}
+
 type SQLiteStore struct {
-	conn *sqlx.DB
+	conn    *sqlx.DB
+	trigram bool
 	*SQLCommonStore
 }
 
 func NewSQLiteStore(uri string) (Store, error) {
-	conn, err := sqlx.Open("sqlite3", uri)
+	conn, err := sqlx.Open("sqlite3_pdns", uri)
 	if err != nil {
 		return nil, err
 	}
-	common := &SQLCommonStore{conn: conn}
+	common := &SQLCommonStore{conn: conn, timeArg: sqliteTimeArg, clientsUnion: "hll_union_agg(clients)"}
 	return &SQLiteStore{conn: conn, SQLCommonStore: common}, nil
 }
 
@@ -72,11 +177,210 @@ func (s *SQLiteStore) Close() error {
 	return s.Close()
 }
 
-func (s *SQLiteStore) Init() error {
-	_, err := s.conn.Exec(schema)
+func sqliteAnswerType(qtype string, answer string) string {
+	return answerType(qtype, answer, false)
+}
+
+func sqliteAnswerIP(rrtype string, answer string) interface{} {
+	return sqliteIP(answerIP(rrtype, answer))
+}
+
+//sqliteColumn is a column added to a table after it was first released.
+//Primary key columns can't be added to an existing table, tables missing
+//one are copied into a new one instead. backfill sets the column for the
+//rows that were there before it.
+type sqliteColumn struct {
+	table    string
+	name     string
+	def      string
+	key      bool
+	backfill string
+}
+
+var sqliteColumns = []sqliteColumn{
+	{table: "tuples", name: "rrtype", def: "character varying", key: true,
+		backfill: "UPDATE tuples SET rrtype = pdns_answer_type(type, answer)"},
+	{table: "tuples", name: "clients", def: "BLOB"},
+	{table: "individual", name: "clients", def: "BLOB"},
+	{table: "tuples", name: "sensor", def: "character varying NOT NULL DEFAULT ''", key: true},
+	{table: "individual", name: "sensor", def: "character varying NOT NULL DEFAULT ''", key: true},
+	{table: "rcodes", name: "sensor", def: "character varying NOT NULL DEFAULT ''", key: true},
+	{table: "filenames", name: "sensor", def: "character varying NOT NULL DEFAULT ''", key: true},
+	{table: "tuples", name: "answer_ip", def: "BLOB",
+		backfill: "UPDATE tuples SET answer_ip = pdns_answer_ip(rrtype, answer) WHERE rrtype IN ('A', 'AAAA')"},
+	{table: "tuples", name: "answer_rev", def: "character varying NOT NULL DEFAULT ''",
+		backfill: "UPDATE tuples SET answer_rev = pdns_answer_rev(rrtype, answer)"},
+	{table: "tuples", name: "original", def: "character varying"},
+	{table: "individual", name: "original", def: "character varying"},
+}
+
+//sqliteCreate returns the statement in schema that creates table
+func sqliteCreate(table string) string {
+	for _, stmt := range strings.Split(schema, ";\n") {
+		if strings.Contains(stmt, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			return stmt
+		}
+	}
+	return ""
+}
+
+func sqliteTableColumns(tx *sqlx.Tx, table string) (map[string]bool, error) {
+	var names []string
+	err := tx.Select(&names, "SELECT name FROM pragma_table_info(?)", table)
+	cols := make(map[string]bool)
+	for _, name := range names {
+		cols[name] = true
+	}
+	return cols, err
+}
+
+//migrate brings tables created by older versions up to date, it runs before
+//schema so the indexes on new columns can be created
+func (s *SQLiteStore) migrate() error {
+	tx, err := s.conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tables := make(map[string]map[string]bool)
+	var missing []sqliteColumn
+	rebuild := make(map[string]bool)
+	for _, col := range sqliteColumns {
+		cols, ok := tables[col.table]
+		if !ok {
+			cols, err = sqliteTableColumns(tx, col.table)
+			if err != nil {
+				return err
+			}
+			tables[col.table] = cols
+		}
+		if len(cols) == 0 || cols[col.name] {
+			continue
+		}
+		missing = append(missing, col)
+		if col.key {
+			rebuild[col.table] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, col := range missing {
+		if rebuild[col.table] {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.name + " " + col.def)
+		if err != nil {
+			return err
+		}
+	}
+	for table := range rebuild {
+		err = sqliteRebuild(tx, table, tables[table])
+		if err != nil {
+			return err
+		}
+	}
+	for _, col := range missing {
+		if col.backfill == "" {
+			continue
+		}
+		_, err = tx.Exec(col.backfill)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+//sqliteRebuild copies table into one created with the current schema. The
+//indexes go with the old table, Init creates them again.
+func sqliteRebuild(tx *sqlx.Tx, table string, oldCols map[string]bool) error {
+	_, err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + table + "_old")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sqliteCreate(table))
+	if err != nil {
+		return err
+	}
+	newCols, err := sqliteTableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	var cols []string
+	for col := range oldCols {
+		if newCols[col] {
+			cols = append(cols, col)
+		}
+	}
+	list := strings.Join(cols, ", ")
+	_, err = tx.Exec("INSERT INTO " + table + " (" + list + ") SELECT " + list + " FROM " + table + "_old")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP TABLE " + table + "_old")
 	return err
 }
 
+func (s *SQLiteStore) Init() error {
+	err := s.migrate()
+	if err != nil {
+		return fmt.Errorf("migrating the database: %w", err)
+	}
+	_, err = s.conn.Exec(schema)
+	if err != nil {
+		return err
+	}
+	var tables int
+	err = s.conn.Get(&tables, "SELECT count(*) FROM sqlite_master WHERE name='individual_trigram'")
+	if err != nil {
+		return err
+	}
+	s.trigram = tables > 0
+	if !s.trigram {
+		return nil
+	}
+	//The triggers that keep the index up to date fail without FTS5, so
+	//nothing could be indexed
+	fts5, err := s.hasFTS5()
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		return fmt.Errorf("the database has a substring index: %w", errNoFTS5)
+	}
+	return nil
+}
+
+//errNoFTS5 is returned when the substring index is needed but sqlite was
+//built without FTS5
+var errNoFTS5 = errors.New("the substring index needs sqlite with FTS5, build zeek-pdns with -tags sqlite_fts5")
+
+func (s *SQLiteStore) hasFTS5() (bool, error) {
+	var used bool
+	err := s.conn.Get(&used, "SELECT sqlite_compileoption_used('ENABLE_FTS5')")
+	return used, err
+}
+
+func (s *SQLiteStore) InitSubstringIndex() error {
+	if s.trigram {
+		return nil
+	}
+	fts5, err := s.hasFTS5()
+	if err != nil {
+		return err
+	}
+	if !fts5 {
+		return fmt.Errorf("can't create the substring index: %w", errNoFTS5)
+	}
+	_, err = s.conn.Exec(sqliteSubstringSchema)
+	if err != nil {
+		return fmt.Errorf("can't create the substring index: %w", err)
+	}
+	s.trigram = true
+	return nil
+}
+
 func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 	var result UpdateResult
 	start := time.Now()
@@ -85,19 +389,21 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 	if err != nil {
 		return result, err
 	}
-	//Setup the 4 different prepared statements
+	//Setup the 6 different prepared statements
 	update_tuples, err := tx.Prepare(`UPDATE tuples SET
 		count=count+$1,
 		ttl=$2,
-		first=min(datetime($3, 'unixepoch'), first),
-		last =max(datetime($4, 'unixepoch'), last)
-		WHERE query=$5 AND type=$6 AND answer=$7`)
+		first=min($3, first),
+		last =max($4, last),
+		clients=hll_union(clients, $5),
+		original=coalesce(original, $6)
+		WHERE query=$7 AND type=$8 AND rrtype=$9 AND answer=$10 AND sensor=$11`)
 	if err != nil {
 		return result, err
 	}
 	defer update_tuples.Close()
-	insert_tuples, err := tx.Prepare(`INSERT INTO tuples (query, type, answer, ttl, count, first, last)
-	    VALUES ($1, $2, $3, $4, $5, datetime($6, 'unixepoch'), datetime($7,'unixepoch'))`)
+	insert_tuples, err := tx.Prepare(`INSERT INTO tuples (query, type, rrtype, answer, ttl, count, first, last, clients, sensor, answer_ip, answer_rev, original)
+	    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`)
 	if err != nil {
 		return result, err
 	}
@@ -105,25 +411,43 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 
 	update_individual, err := tx.Prepare(`UPDATE individual SET
 		count=count+$1,
-		first=min(datetime($2, 'unixepoch'), first),
-		last =max(datetime($3, 'unixepoch'), last)
-		WHERE value=$4 AND which=$5`)
+		first=min($2, first),
+		last =max($3, last),
+		clients=hll_union(clients, $4),
+		original=coalesce(original, $5)
+		WHERE value=$6 AND which=$7 AND sensor=$8`)
 	if err != nil {
 		return result, err
 	}
 	defer update_individual.Close()
-	insert_individual, err := tx.Prepare(`INSERT INTO individual (value, which, count, first, last)
-	    VALUES ($1, $2, $3, datetime($4, 'unixepoch'), datetime($5,'unixepoch'))`)
+	insert_individual, err := tx.Prepare(`INSERT INTO individual (value, which, count, first, last, clients, sensor, original)
+	    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
 	if err != nil {
 		return result, err
 	}
 	defer insert_individual.Close()
 
+	update_rcodes, err := tx.Prepare(`UPDATE rcodes SET
+		count=count+$1,
+		first=min($2, first),
+		last =max($3, last)
+		WHERE query=$4 AND type=$5 AND rcode=$6 AND sensor=$7`)
+	if err != nil {
+		return result, err
+	}
+	defer update_rcodes.Close()
+	insert_rcodes, err := tx.Prepare(`INSERT INTO rcodes (query, type, rcode, count, first, last, sensor)
+	    VALUES ($1, $2, $3, $4, $5, $6, $7)`)
+	if err != nil {
+		return result, err
+	}
+	defer insert_rcodes.Close()
+
 	// Ok, now let's update stuff
 	for _, q := range ar.Tuples {
 		//Update the tuples table
 		query := Reverse(q.query)
-		res, err := update_tuples.Exec(q.count, q.ttl, ToTS(q.first), ToTS(q.last), query, q.qtype, q.answer)
+		res, err := update_tuples.Exec(q.count, q.ttl, sqliteTime(q.first), sqliteTime(q.last), q.clients.bytes(), sqlOriginal(q.original), query, q.qtype, q.rrtype, q.answer, ar.Sensor)
 		if err != nil {
 			return result, err
 		}
@@ -132,7 +456,7 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 			return result, err
 		}
 		if rows == 0 {
-			_, err := insert_tuples.Exec(query, q.qtype, q.answer, q.ttl, q.count, ToTS(q.first), ToTS(q.last))
+			_, err := insert_tuples.Exec(query, q.qtype, q.rrtype, q.answer, q.ttl, q.count, sqliteTime(q.first), sqliteTime(q.last), q.clients.bytes(), ar.Sensor, sqliteIP(answerIP(q.rrtype, q.answer)), reversedAnswer(q.rrtype, q.answer), sqlOriginal(q.original))
 			if err != nil {
 				return result, err
 			}
@@ -146,7 +470,27 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 		if q.which == "Q" {
 			value = Reverse(value)
 		}
-		res, err := update_individual.Exec(q.count, ToTS(q.first), ToTS(q.last), value, q.which)
+		res, err := update_individual.Exec(q.count, sqliteTime(q.first), sqliteTime(q.last), q.clients.bytes(), sqlOriginal(q.original), value, q.which, ar.Sensor)
+		if err != nil {
+			return result, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return result, err
+		}
+		if rows == 0 {
+			_, err := insert_individual.Exec(value, q.which, q.count, sqliteTime(q.first), sqliteTime(q.last), q.clients.bytes(), ar.Sensor, sqlOriginal(q.original))
+			if err != nil {
+				return result, err
+			}
+			result.Inserted++
+		} else {
+			result.Updated++
+		}
+	}
+	for _, q := range ar.Rcodes {
+		query := Reverse(q.query)
+		res, err := update_rcodes.Exec(q.count, sqliteTime(q.first), sqliteTime(q.last), query, q.qtype, q.rcode, ar.Sensor)
 		if err != nil {
 			return result, err
 		}
@@ -155,7 +499,7 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 			return result, err
 		}
 		if rows == 0 {
-			_, err := insert_individual.Exec(value, q.which, q.count, ToTS(q.first), ToTS(q.last))
+			_, err := insert_rcodes.Exec(query, q.qtype, q.rcode, q.count, sqliteTime(q.first), sqliteTime(q.last), ar.Sensor)
 			if err != nil {
 				return result, err
 			}
@@ -167,3 +511,55 @@ func (s *SQLiteStore) Update(ar aggregationResult) (UpdateResult, error) {
 	result.Duration = time.Since(start)
 	return result, s.Commit()
 }
+
+//trigramMatch returns the FTS5 query for a contains search. The trigram
+//tokenizer can't look up anything shorter than 3 characters, those
+//searches scan the tables instead.
+func (s *SQLiteStore) trigramMatch(substring string) (string, bool) {
+	if !s.trigram || utf8.RuneCountInString(substring) < 3 {
+		return "", false
+	}
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	sub := strings.ToLower(substring)
+	return quote(sub) + " OR " + quote(Reverse(sub)), true
+}
+
+//trigramWhere finds the individual values containing substring with the
+//trigram index, the LIKE rechecks the candidates it returns
+func trigramWhere(b *sqlBuilder, match string, substring string) string {
+	return "rowid IN (SELECT rowid FROM individual_trigram WHERE individual_trigram MATCH " + b.arg(match) + ") AND (" + containsIndividualWhere(b, substring) + ")"
+}
+
+func (s *SQLiteStore) ContainsTuples(substring string, opts SearchOptions) (tupleResults, error) {
+	match, ok := s.trigramMatch(substring)
+	if !ok {
+		return s.SQLCommonStore.ContainsTuples(substring, opts)
+	}
+	b := newSQLBuilder()
+	where := "query IN (SELECT value FROM individual WHERE which='Q' AND " + trigramWhere(b, match, substring) + ")" +
+		" OR query IN (SELECT pdns_reverse(value) FROM individual WHERE which='A' AND " + trigramWhere(b, match, substring) + ")" +
+		" OR answer IN (SELECT value FROM individual WHERE which='A' AND " + trigramWhere(b, match, substring) + ")"
+	return s.searchTuples(b, where, opts)
+}
+
+func (s *SQLiteStore) ContainsIndividual(substring string, opts SearchOptions) (individualResults, error) {
+	match, ok := s.trigramMatch(substring)
+	if !ok {
+		return s.SQLCommonStore.ContainsIndividual(substring, opts)
+	}
+	b := newSQLBuilder()
+	return s.searchIndividual(b, trigramWhere(b, match, substring), opts)
+}
+
+//CIDRTuples finds the tuples with an address answer inside prefix
+func (s *SQLiteStore) CIDRTuples(prefix string, opts SearchOptions) (tupleResults, error) {
+	lo, hi, err := ipRange(prefix)
+	if err != nil {
+		return nil, err
+	}
+	b := newSQLBuilder()
+	where := "answer_ip BETWEEN " + b.arg([]byte(lo)) + " AND " + b.arg([]byte(hi))
+	return s.searchTuples(b, where, opts)
+}
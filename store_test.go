@@ -1,10 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -32,7 +37,7 @@ func doTestLogIndexed(t *testing.T, s Store) {
 	s.Clear()
 	s.Init()
 	testFilename := "test.log"
-	indexed, err := s.IsLogIndexed(testFilename)
+	indexed, err := s.IsLogIndexed("", testFilename)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,11 +48,11 @@ func doTestLogIndexed(t *testing.T, s Store) {
 	var ar aggregationResult
 	var ur UpdateResult
 
-	err = s.SetLogIndexed(testFilename, ar, ur)
+	err = s.SetLogIndexed("", testFilename, ar, ur)
 	if err != nil {
 		t.Fatal(err)
 	}
-	indexed, err = s.IsLogIndexed(testFilename)
+	indexed, err = s.IsLogIndexed("", testFilename)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -87,19 +92,19 @@ func doTestUpdating(t *testing.T, s Store, forward bool) {
 
 	// Hack for now. Clickhouse store doesn't report inserted vs updated
 	//TODO: add a method to Store interface to return a bool for this
-	expected_inserted := 31
+	expected_inserted := 32
 	expected_updated := 0
 	if _, ok := s.(*CHStore); ok {
 		expected_inserted = 0
-		expected_updated = 31
+		expected_updated = 32
 	}
 	assert.EqualValues(t, result_a.Inserted, expected_inserted)
 	assert.EqualValues(t, result_a.Updated, expected_updated)
 
 	assert.EqualValues(t, result_b.Inserted, 0)
-	assert.EqualValues(t, result_b.Updated, 31)
+	assert.EqualValues(t, result_b.Updated, 32)
 
-	recs, err := s.FindIndividual("www.reddit.com")
+	recs, err := s.FindIndividual("www.reddit.com", SearchOptions{})
 	if err != nil {
 		t.Fatalf("Failed to find: %v", err)
 		return
@@ -110,15 +115,16 @@ func doTestUpdating(t *testing.T, s Store, forward bool) {
 		assert.Equal(t, rec.Value, "www.reddit.com")
 		assert.Equal(t, rec.Which, "Q")
 		assert.EqualValues(t, rec.Count, 2)
+		assert.EqualValues(t, rec.Clients, 1)
 		//This is stupid, but I need to fix things so that they return actual dates
 		//and get a handle on the timezone BS.
 		//So for now, ignore the ' ' vs 'T' difference, and the hour
-		assert.Regexp(t, "2016-04-01...:03:03", rec.First)
-		assert.Regexp(t, "2016-04-01...:55:04", rec.Last)
+		assert.Regexp(t, "2016-04-01...:03:03\\.75", rec.First)
+		assert.Regexp(t, "2016-04-01...:55:04\\.5", rec.Last)
 	}
 	//www.reddit.com  A       198.41.208.138  2       300     2016-04-01 00:03:03     2016-04-01 21:55:04
 
-	trecs, err := s.FindTuples("198.41.208.138")
+	trecs, err := s.FindTuples("198.41.208.138", SearchOptions{})
 	if err != nil {
 		t.Fatalf("Failed to find: %v", err)
 		return
@@ -127,8 +133,10 @@ func doTestUpdating(t *testing.T, s Store, forward bool) {
 		rec := trecs[0]
 		assert.Equal(t, rec.Query, "www.reddit.com")
 		assert.Equal(t, rec.Type, "A")
+		assert.Equal(t, rec.RRType, "A")
 		assert.Equal(t, rec.Answer, "198.41.208.138")
 		assert.EqualValues(t, rec.Count, 2)
+		assert.EqualValues(t, rec.Clients, 1)
 		//This is stupid, but I need to fix things so that they return actual dates
 		//and get a handle on the timezone BS.
 		//So for now, ignore the ' ' vs 'T' difference, and the hour
@@ -136,6 +144,18 @@ func doTestUpdating(t *testing.T, s Store, forward bool) {
 		assert.Regexp(t, "2016-04-01...:55:04", rec.Last)
 	}
 
+	rrecs, err := s.FindRcodes("www.reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatalf("Failed to find: %v", err)
+		return
+	}
+	if assert.Equal(t, len(rrecs), 1) {
+		rec := rrecs[0]
+		assert.Equal(t, rec.Query, "www.reddit.com")
+		assert.Equal(t, rec.Type, "A")
+		assert.Equal(t, rec.Rcode, "NOERROR")
+		assert.EqualValues(t, rec.Count, 2)
+	}
 }
 
 // Output:
@@ -230,3 +250,995 @@ func TestStoreIndexing(t *testing.T) {
 		})
 	}
 }
+
+func TestIndexReader(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			name := "sensor1/dns.log"
+			for i := 0; i < 2; i++ {
+				f, err := os.Open("test_data/reddit_1.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = indexReader(store, "", f, name)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			indexed, err := store.IsLogIndexed("", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, indexed)
+
+			//The second run should have been skipped as already indexed
+			recs, err := store.FindIndividual("www.reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, recs, 1) {
+				assert.EqualValues(t, 1, recs[0].Count)
+			}
+		})
+	}
+}
+
+func TestRcodes(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			LoadFile(t, store, "test_data/rcodes.json")
+
+			recs, err := store.FindRcodes("qxkzvbnw.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, recs, 2) {
+				assert.Equal(t, "A", recs[0].Type)
+				assert.Equal(t, "NXDOMAIN", recs[0].Rcode)
+				assert.EqualValues(t, 2, recs[0].Count)
+				assert.Equal(t, "AAAA", recs[1].Type)
+				assert.Equal(t, "SERVFAIL", recs[1].Rcode)
+				assert.EqualValues(t, 1, recs[1].Count)
+			}
+
+			//A query that never got a response has no rcode, but is still
+			//recorded as an individual query
+			recs, err = store.LikeRcodes("example.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, recs, 0)
+			irecs, err := store.FindIndividual("noresponse.example.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, irecs, 1)
+		})
+	}
+}
+
+func TestStoreClients(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			//Clients 0-14 and then 10-24, so 25 distinct clients in total
+			for batch := 0; batch < 2; batch++ {
+				ag := NewDNSAggregator()
+				for i := batch * 10; i < batch*10+15; i++ {
+					ag.AddRecord(DNSRecord{
+						ts:      time.Unix(int64(i), 0).UTC(),
+						client:  fmt.Sprintf("192.168.1.%d", i),
+						query:   "www.example.com",
+						qtype:   "A",
+						answers: []string{"1.2.3.4"},
+						ttls:    []string{"300"},
+					})
+				}
+				_, err = store.Update(ag.GetResult())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			trecs, err := store.FindTuples("www.example.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, trecs, 1) {
+				assert.EqualValues(t, 30, trecs[0].Count)
+				assert.EqualValues(t, 25, trecs[0].Clients)
+			}
+			irecs, err := store.FindIndividual("1.2.3.4", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, irecs, 1) {
+				assert.EqualValues(t, 25, irecs[0].Clients)
+			}
+		})
+	}
+}
+
+func TestSensors(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			//Both sensors have a dns.log, neither should be skipped
+			name := "dns.log"
+			for _, sensor := range []string{"sensor1", "sensor2"} {
+				f, err := os.Open("test_data/reddit_1.txt")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = indexReader(store, sensor, f, name)
+				f.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				indexed, err := store.IsLogIndexed(sensor, name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assert.True(t, indexed, sensor)
+			}
+			indexed, err := store.IsLogIndexed("", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.False(t, indexed)
+
+			merged, err := store.FindIndividual("www.reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, merged, 1) {
+				assert.Equal(t, "", merged[0].Sensor)
+				assert.EqualValues(t, 2, merged[0].Count)
+				//The same clients were seen by both sensors
+				assert.EqualValues(t, 1, merged[0].Clients)
+			}
+
+			bySensor, err := store.FindIndividual("www.reddit.com", SearchOptions{BySensor: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, bySensor, 2) {
+				assert.Equal(t, "sensor1", bySensor[0].Sensor)
+				assert.Equal(t, "sensor2", bySensor[1].Sensor)
+				assert.EqualValues(t, 1, bySensor[0].Count)
+				assert.EqualValues(t, 1, bySensor[1].Count)
+			}
+
+			tuples, err := store.FindTuples("www.reddit.com", SearchOptions{Sensor: "sensor2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.NotEmpty(t, tuples) {
+				for _, tr := range tuples {
+					assert.Equal(t, "sensor2", tr.Sensor)
+					assert.EqualValues(t, 1, tr.Count)
+				}
+			}
+			tuples, err = store.FindTuples("www.reddit.com", SearchOptions{Sensor: "sensor3"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Empty(t, tuples)
+		})
+	}
+}
+
+func TestNormalizedSearch(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			ag.AddRecord(DNSRecord{
+				ts:      time.Unix(10, 0).UTC(),
+				query:   "WWW.Bücher.Example.",
+				qtype:   "TXT",
+				answers: []string{"TXT Hello World"},
+				ttls:    []string{"300"},
+			})
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			//Later spellings don't replace the first one
+			ag = NewDNSAggregator()
+			ag.AddRecord(DNSRecord{
+				ts:      time.Unix(20, 0).UTC(),
+				query:   "www.bücher.example",
+				qtype:   "TXT",
+				answers: []string{"TXT Hello World"},
+				ttls:    []string{"300"},
+			})
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range []string{"www.bücher.example", "www.xn--bcher-kva.example", "WWW.XN--BCHER-KVA.EXAMPLE."} {
+				trecs, err := store.FindTuples(q, SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if assert.Len(t, trecs, 1, q) {
+					assert.Equal(t, "www.xn--bcher-kva.example", trecs[0].Query)
+					assert.Equal(t, "WWW.Bücher.Example.", trecs[0].Original)
+				}
+				irecs, err := store.FindIndividual(q, SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if assert.Len(t, irecs, 1, q) {
+					assert.Equal(t, "WWW.Bücher.Example.", irecs[0].Original)
+				}
+			}
+			trecs, err := store.FindTuples("www.bücher.example", SearchOptions{BySensor: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, trecs, 1) {
+				assert.Equal(t, "WWW.Bücher.Example.", trecs[0].Original)
+			}
+			trecs, err = store.LikeTuples("Bücher.Example", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, trecs, 1)
+			//Answers that aren't names keep their case
+			trecs, err = store.FindTuples("TXT Hello World", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, trecs, 1)
+		})
+	}
+}
+
+func TestLikeLabels(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for query, answer := range map[string]string{
+				"google.com":     "10.1.2.3",
+				"www.google.com": "10.1.2.4",
+				"evilgoogle.com": "10.10.2.3",
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   query,
+					qtype:   "A",
+					rcode:   "NOERROR",
+					answers: []string{answer},
+					ttls:    []string{"300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries := func(tr tupleResults) []string {
+				var names []string
+				for _, r := range tr {
+					names = append(names, r.Query)
+				}
+				return names
+			}
+
+			trecs, err := store.LikeTuples("google.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, []string{"google.com", "www.google.com"}, queries(trecs))
+			trecs, err = store.LikeTuples("google.com", SearchOptions{RawPrefix: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, []string{"google.com", "www.google.com", "evilgoogle.com"}, queries(trecs))
+			trecs, err = store.LikeTuples("10.1", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, []string{"google.com", "www.google.com"}, queries(trecs))
+
+			irecs, err := store.LikeIndividual("google.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, irecs, 2)
+			rrecs, err := store.LikeRcodes("google.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, rrecs, 2)
+			rrecs, err = store.LikeRcodes("google.com", SearchOptions{RawPrefix: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, rrecs, 3)
+		})
+	}
+}
+
+func TestCIDRTuples(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for query, answers := range map[string][]string{
+				"a.example.com": {"10.1.2.3"},
+				"b.example.com": {"10.10.2.3"},
+				"c.example.com": {"10.100.0.1", "1.2.3.4"},
+				"d.example.com": {"2001:db8::1"},
+				"e.example.com": {"2001:db8:0:0:1::2"},
+				"f.example.com": {"10.1.example.com"},
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   query,
+					qtype:   "A",
+					answers: answers,
+					ttls:    []string{"300", "300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for prefix, want := range map[string][]string{
+				"10.1.0.0/16":            {"10.1.2.3"},
+				"10.0.0.0/8":             {"10.1.2.3", "10.10.2.3", "10.100.0.1"},
+				"10.1.0.0-10.10.255.255": {"10.1.2.3", "10.10.2.3"},
+				"2001:0db8::/32":         {"2001:db8::1", "2001:db8:0:0:1::2"},
+				"2001:db8::/80":          {"2001:db8::1"},
+				"192.168.0.0/16":         nil,
+			} {
+				trecs, err := store.CIDRTuples(prefix, SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var answers []string
+				for _, r := range trecs {
+					answers = append(answers, r.Answer)
+				}
+				assert.ElementsMatch(t, want, answers, prefix)
+			}
+			_, err = store.CIDRTuples("www.example.com", SearchOptions{})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLikeAnswers(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for query, answers := range map[string][]string{
+				"www.example.com":    {"d123.cloudfront.net", "1.2.3.4"},
+				"static.example.com": {"evilcloudfront.net", "1.2.3.5"},
+				"cdn.example.com":    {"cloudfront.net", "1.2.3.6"},
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   query,
+					qtype:   "A",
+					answers: answers,
+					ttls:    []string{"300", "300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries := func(tr tupleResults) []string {
+				var names []string
+				for _, r := range tr {
+					assert.Equal(t, "CNAME", r.RRType)
+					names = append(names, r.Query)
+				}
+				return names
+			}
+			trecs, err := store.LikeAnswers("CloudFront.NET.", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, []string{"www.example.com", "cdn.example.com"}, queries(trecs))
+			trecs, err = store.LikeAnswers("cloudfront.net", SearchOptions{RawPrefix: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.ElementsMatch(t, []string{"www.example.com", "static.example.com", "cdn.example.com"}, queries(trecs))
+		})
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for query, answer := range map[string]string{
+				"www.corp.example.com":              "10.1.2.3",
+				"corp.example.com":                  "10.1.2.4",
+				"mail1.example.com":                 "10.1.2.5",
+				"mail_2.example.com":                "10.1.2.6",
+				"mailxexample.com":                  "10.1.2.7",
+				"login-eu-microsoftonline.com":      "login.msft.net",
+				"www.example.org":                   "edge.corp.example.com",
+				"login-us-microsoft.phishy.example": "10.1.2.8",
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   query,
+					qtype:   "A",
+					answers: []string{answer},
+					ttls:    []string{"300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for pattern, want := range map[string][]string{
+				"*.corp.example.com":  {"www.corp.example.com", "www.example.org"},
+				"mail*.example.com":   {"mail1.example.com", "mail_2.example.com"},
+				"mail?.example.com":   {"mail1.example.com"},
+				"login-*-microsoft*":  {"login-eu-microsoftonline.com", "login-us-microsoft.phishy.example"},
+				"MAIL_2.Example.COM.": {"mail_2.example.com"},
+				"10.1.2.?":            {"www.corp.example.com", "corp.example.com", "mail1.example.com", "mail_2.example.com", "mailxexample.com", "login-us-microsoft.phishy.example"},
+				"*.nomatch.example":   nil,
+			} {
+				trecs, err := store.GlobTuples(pattern, SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var queries []string
+				for _, r := range trecs {
+					queries = append(queries, r.Query)
+				}
+				assert.ElementsMatch(t, want, queries, pattern)
+			}
+			irecs, err := store.GlobIndividual("*.corp.example.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values []string
+			for _, r := range irecs {
+				values = append(values, r.Value)
+			}
+			assert.ElementsMatch(t, []string{"www.corp.example.com", "edge.corp.example.com"}, values)
+		})
+	}
+}
+
+func TestContains(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for query, answer := range map[string]string{
+				"www.paypal.com":              "10.1.2.3",
+				"paypal-login.example":        "10.1.2.4",
+				"secure.paypa1.example":       "10.1.2.5",
+				"cdn.example.org":             "paypal.map.fastly.net",
+				"mail.example.com":            "10.1.2.6",
+				"login.secure-paypal.example": "10.1.2.7",
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   query,
+					qtype:   "A",
+					answers: []string{answer},
+					ttls:    []string{"300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(t *testing.T) {
+				for sub, want := range map[string][]string{
+					"paypal":   {"www.paypal.com", "paypal-login.example", "cdn.example.org", "login.secure-paypal.example"},
+					"PayPal":   {"www.paypal.com", "paypal-login.example", "cdn.example.org", "login.secure-paypal.example"},
+					"pal.com":  {"www.paypal.com"},
+					"paypa1":   {"secure.paypa1.example"},
+					"pa":       {"www.paypal.com", "paypal-login.example", "secure.paypa1.example", "cdn.example.org", "login.secure-paypal.example"},
+					"10.1.2.6": {"mail.example.com"},
+					"nomatch":  nil,
+				} {
+					trecs, err := store.ContainsTuples(sub, SearchOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					var queries []string
+					for _, r := range trecs {
+						queries = append(queries, r.Query)
+					}
+					assert.ElementsMatch(t, want, queries, sub)
+				}
+				irecs, err := store.ContainsIndividual("paypal.", SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var values []string
+				for _, r := range irecs {
+					values = append(values, r.Value)
+				}
+				assert.ElementsMatch(t, []string{"www.paypal.com", "login.secure-paypal.example", "paypal.map.fastly.net"}, values)
+			}
+			t.Run("scan", check)
+			err = store.InitSubstringIndex()
+			if err != nil {
+				t.Skipf("no substring index: %v", err)
+			}
+			t.Run("index", check)
+		})
+	}
+}
+
+//The owners in a CNAME chain are only individual values as answers
+func TestContainsAnsQuery(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			ag.AddRecord(DNSRecord{
+				ts:         time.Unix(10, 0).UTC(),
+				query:      "www.example.com",
+				qtype:      "A",
+				answers:    []string{"www.example.com.cdn.net", "edge.cdn.net", "10.1.2.3"},
+				ttls:       []string{"300", "60", "20"},
+				ansQueries: []string{"www.example.com", "www.example.com.cdn.net", "edge.cdn.net"},
+			})
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := func(t *testing.T) {
+				trecs, err := store.ContainsTuples("edge", SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var tuples []string
+				for _, r := range trecs {
+					tuples = append(tuples, r.Query+" "+r.Answer)
+				}
+				assert.ElementsMatch(t, []string{
+					"edge.cdn.net 10.1.2.3",
+					"www.example.com.cdn.net edge.cdn.net",
+				}, tuples)
+			}
+			t.Run("scan", check)
+			err = store.InitSubstringIndex()
+			if err != nil {
+				t.Skipf("no substring index: %v", err)
+			}
+			t.Run("index", check)
+		})
+	}
+}
+
+func TestSQLiteSubstringIndex(t *testing.T) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Clear()
+	store.Init()
+	fts5, err := store.(*SQLiteStore).hasFTS5()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.InitSubstringIndex()
+	if fts5 {
+		assert.NoError(t, err)
+		assert.NoError(t, store.Init())
+	} else {
+		assert.True(t, errors.Is(err, errNoFTS5), "err = %v", err)
+	}
+}
+
+//openOldSQLite returns a store for a database created by an older version
+//from fixture
+func openOldSQLite(t *testing.T, fixture string) Store {
+	sql, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "pdns.sqlite")
+	conn, err := sqlx.Open("sqlite3_pdns", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(string(sql))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore("sqlite", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	store := openOldSQLite(t, "test_data/sqlite_schema_v0.sql")
+	//Migrating twice does nothing
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := store.FindTuples("www.reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rrtypes := make(map[string]string)
+	for _, r := range recs {
+		rrtypes[r.Answer] = r.RRType
+	}
+	assert.Equal(t, map[string]string{"reddit.map.fastly.net": "CNAME", "198.41.209.142": "A"}, rrtypes)
+	recs, err = store.FindTuples("reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "MX", recs[0].RRType)
+	}
+
+	recs, err = store.CIDRTuples("198.41.209.0/24", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, recs, 1)
+	recs, err = store.LikeAnswers("reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "mx.reddit.com", recs[0].Answer)
+	}
+	indexed, err := store.IsLogIndexed("", "reddit_dns_2016-04-01.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, indexed)
+
+	//New records for the old keys update the migrated rows
+	LoadFile(t, store, "test_data/reddit_1.txt")
+	recs, err = store.FindTuples("198.41.209.142", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, uint(3), recs[0].Count)
+	}
+}
+
+func TestSQLiteMigrateAnswers(t *testing.T) {
+	store := openOldSQLite(t, "test_data/sqlite_schema_v1.sql")
+	recs, err := store.CIDRTuples("198.41.209.0/24", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, recs, 1)
+	recs, err = store.LikeAnswers("reddit.com", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, recs, 1) {
+		assert.Equal(t, "mx.reddit.com", recs[0].Answer)
+	}
+}
+
+func TestTimeFences(t *testing.T) {
+	day := func(d int64) time.Time {
+		return time.Unix(d*86400, 0).UTC()
+	}
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			for _, sensor := range []struct {
+				name    string
+				day     int64
+				queries []string
+			}{
+				{"sensor1", 1, []string{"old.example.com", "both.example.com"}},
+				{"sensor2", 10, []string{"new.example.com", "both.example.com"}},
+			} {
+				ag := NewDNSAggregator()
+				for _, query := range sensor.queries {
+					ag.AddRecord(DNSRecord{
+						ts:      day(sensor.day),
+						query:   query,
+						qtype:   "A",
+						rcode:   "NOERROR",
+						answers: []string{"10.1.2.3"},
+						ttls:    []string{"300"},
+					})
+				}
+				ar := ag.GetResult()
+				ar.Sensor = sensor.name
+				_, err = store.Update(ar)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range []struct {
+				name string
+				opts SearchOptions
+				want []string
+			}{
+				{"first after", SearchOptions{FirstAfter: day(5)}, []string{"new.example.com"}},
+				{"last before", SearchOptions{LastBefore: day(5)}, []string{"old.example.com"}},
+				{"first before last after", SearchOptions{FirstBefore: day(5), LastAfter: day(5)}, []string{"both.example.com"}},
+				{"first after by sensor", SearchOptions{FirstAfter: day(5), BySensor: true}, []string{"both.example.com", "new.example.com"}},
+				{"sensor", SearchOptions{LastBefore: day(5), Sensor: "sensor1"}, []string{"both.example.com", "old.example.com"}},
+				{"none", SearchOptions{FirstAfter: day(11)}, nil},
+			} {
+				tuples, err := store.LikeTuples("example.com", tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var queries []string
+				for _, r := range tuples {
+					queries = append(queries, r.Query)
+				}
+				assert.ElementsMatch(t, tt.want, queries, tt.name)
+			}
+			individual, err := store.LikeIndividual("example.com", SearchOptions{FirstAfter: day(5)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values []string
+			for _, r := range individual {
+				values = append(values, r.Value)
+			}
+			assert.Equal(t, []string{"new.example.com"}, values)
+			rcodes, err := store.LikeRcodes("example.com", SearchOptions{LastBefore: day(5)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rqueries []string
+			for _, r := range rcodes {
+				rqueries = append(rqueries, r.Query)
+			}
+			assert.Equal(t, []string{"old.example.com"}, rqueries)
+		})
+	}
+}
+
+func TestPaging(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			//a is seen once on day 3, b twice on day 2, and so on
+			for i, query := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+				for n := 0; n <= i; n++ {
+					ag.AddRecord(DNSRecord{
+						ts:      time.Unix(int64(3-i)*86400, 0).UTC(),
+						query:   query,
+						qtype:   "A",
+						answers: []string{"10.1.2.3"},
+						ttls:    []string{"300"},
+					})
+				}
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			queries := func(opts SearchOptions) []string {
+				tuples, err := store.LikeTuples("example.com", opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var queries []string
+				for _, r := range tuples {
+					queries = append(queries, r.Query)
+				}
+				return queries
+			}
+			assert.Equal(t, []string{"a.example.com", "b.example.com"}, queries(SearchOptions{Limit: 2}))
+			assert.Equal(t, []string{"c.example.com", "d.example.com"}, queries(SearchOptions{Limit: 2, Offset: 2}))
+			assert.Equal(t, []string{"d.example.com", "c.example.com", "b.example.com", "a.example.com"}, queries(SearchOptions{Sort: "-name"}))
+			assert.Equal(t, []string{"d.example.com", "c.example.com"}, queries(SearchOptions{Sort: "-count", Limit: 2}))
+			assert.Equal(t, []string{"d.example.com", "c.example.com", "b.example.com", "a.example.com"}, queries(SearchOptions{Sort: "first"}))
+			assert.Equal(t, []string{"a.example.com"}, queries(SearchOptions{Sort: "-last", Limit: 1}))
+			assert.Equal(t, []string{"d.example.com"}, queries(SearchOptions{Sort: "count", Limit: 1, Offset: 3, BySensor: true}))
+
+			for _, opts := range []SearchOptions{
+				{Sort: "clients"},
+				{Limit: -1},
+				{Limit: 2, Offset: -1},
+				{Offset: 2},
+			} {
+				_, err = store.LikeTuples("example.com", opts)
+				assert.Error(t, err, opts)
+			}
+
+			opts := SearchOptions{Limit: 3}
+			tuples, more, err := tuplePage(store.LikeTuples, "example.com", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, tuples, 3)
+			assert.True(t, more)
+			opts.Offset = 3
+			tuples, more, err = tuplePage(store.LikeTuples, "example.com", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, tuples, 1)
+			assert.False(t, more)
+		})
+	}
+}
+
+func TestRRTypes(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			ag := NewDNSAggregator()
+			for qtype, answer := range map[string]string{
+				"A":    "10.1.2.3",
+				"AAAA": "2001:db8::1",
+				"MX":   "mail.example.com",
+			} {
+				ag.AddRecord(DNSRecord{
+					ts:      time.Unix(10, 0).UTC(),
+					query:   "example.com",
+					qtype:   qtype,
+					answers: []string{answer},
+					ttls:    []string{"300"},
+				})
+			}
+			_, err = store.Update(ag.GetResult())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tt := range []struct {
+				rrtypes []string
+				want    []string
+			}{
+				{nil, []string{"10.1.2.3", "2001:db8::1", "mail.example.com"}},
+				{[]string{"mx"}, []string{"mail.example.com"}},
+				{[]string{"A", "AAAA"}, []string{"10.1.2.3", "2001:db8::1"}},
+				{[]string{"TXT"}, nil},
+			} {
+				tuples, err := store.FindTuples("example.com", SearchOptions{RRTypes: tt.rrtypes})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var answers []string
+				for _, r := range tuples {
+					answers = append(answers, r.Answer)
+				}
+				assert.ElementsMatch(t, tt.want, answers, tt.rrtypes)
+			}
+			//Answers that are names are found from the other side too
+			tuples, err := store.LikeAnswers("example.com", SearchOptions{RRTypes: []string{"MX"}, BySensor: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, tuples, 1) {
+				assert.Equal(t, "MX", tuples[0].RRType)
+			}
+		})
+	}
+}
+
+func TestExportTuples(t *testing.T) {
+	for _, ts := range testStores {
+		t.Run(ts.storetype, func(t *testing.T) {
+			store, err := NewStore(ts.storetype, ts.uri)
+			if err != nil {
+				t.Fatalf("can't create store at %s: %v", ts.uri, err)
+			}
+			store.Clear()
+			store.Init()
+			LoadFile(t, store, "test_data/reddit_1.txt")
+			want, err := store.LikeTuples("reddit.com", SearchOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got tupleResults
+			err = store.ExportTuples(SearchOptions{}, func(tr tupleResult) error {
+				got = append(got, tr)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, got)
+
+			//Everything the search options do applies to exports too
+			got = nil
+			err = store.ExportTuples(SearchOptions{Limit: 2, Sort: "-name"}, func(tr tupleResult) error {
+				got = append(got, tr)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, got, 2) {
+				assert.Equal(t, "www.reddit.com", got[0].Query)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+-- A database created before rrtypes, sensors and client counts were stored
+CREATE TABLE IF NOT EXISTS tuples (
+	query character varying,
+	type character varying,
+	answer character varying,
+	count integer,
+	ttl integer,
+	first REAL,
+	last REAL,
+	PRIMARY KEY (query, type, answer)
+) ;
+CREATE INDEX IF NOT EXISTS tuples_query ON tuples(query);
+CREATE INDEX IF NOT EXISTS tuples_answer ON tuples(answer);
+CREATE INDEX IF NOT EXISTS tuples_first ON tuples(first);
+CREATE INDEX IF NOT EXISTS tuples_last ON tuples(last);
+
+CREATE TABLE IF NOT EXISTS individual (
+	which char(1),
+	value character varying,
+	count integer,
+	first REAL,
+	last REAL,
+	PRIMARY KEY (which, value)
+);
+CREATE INDEX IF NOT EXISTS individual_first ON individual(first);
+CREATE INDEX IF NOT EXISTS individual_last ON individual(last);
+
+CREATE TABLE IF NOT EXISTS filenames (
+	filename character varying PRIMARY KEY UNIQUE NOT NULL,
+	time REAL DEFAULT (datetime('now', 'localtime')),
+	aggregation_time real,
+	total_records int,
+	skipped_records int,
+	tuples int,
+	individual int,
+	store_time real,
+	inserted int,
+	updated int
+);
+INSERT INTO tuples VALUES ('moc.tidder.www', 'A', 'reddit.map.fastly.net', 2, 300, '2016-04-01 00:03:03', '2016-04-01 21:55:04');
+INSERT INTO tuples VALUES ('moc.tidder.www', 'A', '198.41.209.142', 2, 30, '2016-04-01 00:03:03', '2016-04-01 21:55:04');
+INSERT INTO tuples VALUES ('moc.tidder', 'MX', 'mx.reddit.com', 1, 300, '2016-04-01 00:03:03', '2016-04-01 00:03:03');
+INSERT INTO individual VALUES ('Q', 'moc.tidder.www', 2, '2016-04-01 00:03:03', '2016-04-01 21:55:04');
+INSERT INTO individual VALUES ('A', '198.41.209.142', 2, '2016-04-01 00:03:03', '2016-04-01 21:55:04');
+INSERT INTO filenames (filename, total_records) VALUES ('reddit_dns_2016-04-01.log', 3);
@@ -0,0 +1,16 @@
+-- A tuples table from before answers were indexed by address and reversed name
+CREATE TABLE IF NOT EXISTS tuples (
+	sensor character varying NOT NULL DEFAULT '',
+	query character varying,
+	type character varying,
+	rrtype character varying,
+	answer character varying,
+	count integer,
+	clients BLOB,
+	ttl integer,
+	first REAL,
+	last REAL,
+	PRIMARY KEY (query, type, rrtype, answer, sensor)
+) ;
+INSERT INTO tuples VALUES ('edge', 'moc.tidder.www', 'A', 'A', '198.41.209.142', 2, NULL, 30, '2016-04-01 00:03:03', '2016-04-01 21:55:04');
+INSERT INTO tuples VALUES ('edge', 'moc.tidder', 'MX', 'MX', 'mx.reddit.com', 1, NULL, 300, '2016-04-01 00:03:03', '2016-04-01 00:03:03');
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type watchFailure struct {
+	count int
+	next  time.Time
+}
+
+//watcher periodically scans a zeek log archive for rotated logs, like
+//YYYY-MM-DD/dns.*.log.gz, and indexes the ones that haven't been indexed
+//yet.
+type watcher struct {
+	store      Store
+	sensor     string
+	dir        string
+	pattern    string
+	interval   time.Duration
+	settle     time.Duration
+	batchSize  int
+	retryDelay time.Duration
+	maxBackoff time.Duration
+
+	indexed  map[string]bool
+	failures map[string]*watchFailure
+}
+
+func newWatcher(store Store, dir string) *watcher {
+	return &watcher{
+		store:      store,
+		dir:        dir,
+		pattern:    "dns.*.log*",
+		interval:   60 * time.Second,
+		settle:     30 * time.Second,
+		batchSize:  50,
+		retryDelay: 60 * time.Second,
+		maxBackoff: 6 * time.Hour,
+		indexed:    make(map[string]bool),
+		failures:   make(map[string]*watchFailure),
+	}
+}
+
+//scan returns the logs that still need to be indexed, oldest first. Logs
+//modified within the settle time may still be being compressed or
+//written, so they are left for a later scan.
+func (w *watcher) scan(now time.Time) ([]string, error) {
+	var pending []string
+	err := filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("watch: %s: %v", path, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || w.indexed[path] {
+			return nil
+		}
+		match, err := filepath.Match(w.pattern, info.Name())
+		if err != nil {
+			return err
+		}
+		if !match || now.Sub(info.ModTime()) < w.settle {
+			return nil
+		}
+		if f, ok := w.failures[path]; ok && now.Before(f.next) {
+			return nil
+		}
+		indexed, err := w.store.IsLogIndexed(w.sensor, path)
+		if err != nil {
+			return fmt.Errorf("store.IsLogIndexed: %w", err)
+		}
+		if indexed {
+			w.indexed[path] = true
+			return nil
+		}
+		pending = append(pending, path)
+		return nil
+	})
+	sort.Strings(pending)
+	return pending, err
+}
+
+//fail schedules a retry of a log that couldn't be indexed, doubling the
+//delay after every consecutive failure
+func (w *watcher) fail(fn string, now time.Time, err error) {
+	f, ok := w.failures[fn]
+	if !ok {
+		f = &watchFailure{}
+		w.failures[fn] = f
+	}
+	delay := w.retryDelay << uint(f.count)
+	if delay > w.maxBackoff || delay <= 0 {
+		delay = w.maxBackoff
+	}
+	f.count++
+	f.next = now.Add(delay)
+	log.Printf("watch: %s: failed %d times, retrying in %s: %v", fn, f.count, delay, err)
+}
+
+func (w *watcher) succeed(fn string) {
+	w.indexed[fn] = true
+	delete(w.failures, fn)
+}
+
+//indexBatch indexes a batch of logs in a single transaction. If that fails
+//the logs are retried one at a time so only the broken ones are put on
+//hold.
+func (w *watcher) indexBatch(files []string, now time.Time) {
+	err := index(w.store, w.sensor, files)
+	if err == nil {
+		for _, fn := range files {
+			w.succeed(fn)
+		}
+		return
+	}
+	if len(files) == 1 {
+		w.fail(files[0], now, err)
+		return
+	}
+	log.Printf("watch: batch of %d logs failed, indexing them individually: %v", len(files), err)
+	for _, fn := range files {
+		err = index(w.store, w.sensor, []string{fn})
+		if err != nil {
+			w.fail(fn, now, err)
+		} else {
+			w.succeed(fn)
+		}
+	}
+}
+
+//run scans and indexes until ctx is cancelled. Cancelling doesn't interrupt
+//a batch in progress, it is committed before run returns.
+func (w *watcher) run(ctx context.Context) error {
+	for {
+		pending, err := w.scan(time.Now())
+		if err != nil {
+			//Most likely the store is unavailable, try again next time
+			log.Printf("watch: scanning %s failed: %v", w.dir, err)
+		}
+		if len(pending) > 0 {
+			log.Printf("watch: %d new logs in %s", len(pending), w.dir)
+		}
+		for len(pending) > 0 {
+			if ctx.Err() != nil {
+				return nil
+			}
+			n := w.batchSize
+			if n > len(pending) {
+				n = len(pending)
+			}
+			w.indexBatch(pending[:n], time.Now())
+			pending = pending[n:]
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+func watch(store Store, sensor string, dir string, pattern string, interval time.Duration, settle time.Duration, batchSize int) error {
+	ctx, cancel := signalContext()
+	defer cancel()
+	w := newWatcher(store, dir)
+	w.sensor = sensor
+	w.pattern = pattern
+	w.interval = interval
+	w.settle = settle
+	w.batchSize = batchSize
+	if w.batchSize < 1 {
+		w.batchSize = 1
+	}
+	log.Printf("watch: watching %s for %s every %s", dir, pattern, interval)
+	return w.run(ctx)
+}
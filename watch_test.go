@@ -0,0 +1,99 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeGzip(t *testing.T, src string, dst string) {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day1 := filepath.Join(dir, "2016-04-01")
+	day2 := filepath.Join(dir, "2016-04-02")
+	os.Mkdir(day1, 0755)
+	os.Mkdir(day2, 0755)
+	good1 := filepath.Join(day1, "dns.00:00:00-01:00:00.log.gz")
+	good2 := filepath.Join(day2, "dns.00:00:00-01:00:00.log.gz")
+	bad := filepath.Join(day2, "dns.01:00:00-02:00:00.log.gz")
+	writeGzip(t, "test_data/reddit_1.txt", good1)
+	writeGzip(t, "test_data/reddit_2.txt", good2)
+	writeGzip(t, "test_data/dns_json.log", filepath.Join(day1, "conn.00:00:00-01:00:00.log.gz"))
+	assert.NoError(t, ioutil.WriteFile(bad, []byte("not a zeek log\n"), 0644))
+
+	w := newWatcher(store, dir)
+	w.settle = time.Minute
+	now := time.Now()
+
+	//Everything was just written, so nothing has settled yet
+	pending, err := w.scan(now)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+
+	now = now.Add(2 * time.Minute)
+	pending, err = w.scan(now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{good1, good2, bad}, pending)
+
+	w.indexBatch(pending, now)
+	assert.True(t, w.indexed[good1])
+	assert.True(t, w.indexed[good2])
+	if assert.Contains(t, w.failures, bad) {
+		assert.Equal(t, 1, w.failures[bad].count)
+	}
+
+	recs, err := store.FindIndividual("www.reddit.com", SearchOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, recs, 1) {
+		assert.EqualValues(t, 2, recs[0].Count)
+	}
+
+	//The broken log is retried only after its backoff expires
+	pending, err = w.scan(now)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	now = now.Add(w.retryDelay + time.Second)
+	pending, err = w.scan(now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{bad}, pending)
+	w.indexBatch(pending, now)
+	assert.Equal(t, 2, w.failures[bad].count)
+	assert.Equal(t, now.Add(2*w.retryDelay), w.failures[bad].next)
+
+	//A fresh watcher uses IsLogIndexed to skip what was already done
+	w2 := newWatcher(store, dir)
+	w2.settle = 0
+	pending, err = w2.scan(now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{bad}, pending)
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
-	"text/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -14,7 +20,144 @@ import (
 var content embed.FS
 
 type pdnsHandler struct {
-	s Store
+	s            Store
+	pushToken    string
+	pushMaxBytes int64
+	pushLock     sync.Mutex
+}
+
+//webConfig is the optional parts of the HTTP API. Push is only served when
+//there is a pushToken for sensors to authenticate with, pushMaxBytes
+//defaults to defaultPushMaxBytes.
+type webConfig struct {
+	dnsdb        bool
+	pushToken    string
+	pushMaxBytes int64
+}
+
+//formBool reads a boolean parameter. Checkboxes in the UI send "on".
+func formBool(req *http.Request, name string) bool {
+	value := req.FormValue(name)
+	b, _ := strconv.ParseBool(value)
+	return b || value == "on"
+}
+
+//formList reads a parameter that can be repeated or a comma separated
+//list, or both
+func formList(req *http.Request, name string) []string {
+	req.ParseForm()
+	var values []string
+	for _, value := range req.Form[name] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+//apiDefaultLimit is the limit of the JSON endpoints when none is given.
+//webMaxLimit is the most records any page of the HTTP API holds, a limit
+//of 0 or above it asks for that many.
+const apiDefaultLimit = 1000
+const webMaxLimit = 100000
+
+//requestSearchOptions reads the optional sensor, by_sensor, raw, type,
+//limit, offset and sort parameters and the time fences, named like they
+//are in dnsdb. Without a limit parameter pages have defaultLimit records.
+func requestSearchOptions(req *http.Request, defaultLimit int) (SearchOptions, error) {
+	opts := SearchOptions{
+		Sensor:    req.FormValue("sensor"),
+		BySensor:  formBool(req, "by_sensor"),
+		RawPrefix: formBool(req, "raw"),
+		RRTypes:   formList(req, "type"),
+		Limit:     defaultLimit,
+		Sort:      req.FormValue("sort"),
+	}
+	var err error
+	for name, n := range map[string]*int{
+		"limit":  &opts.Limit,
+		"offset": &opts.Offset,
+	} {
+		if value := req.FormValue(name); value != "" {
+			*n, err = strconv.Atoi(value)
+			if err != nil || *n < 0 {
+				return opts, fmt.Errorf("invalid %s %q", name, value)
+			}
+		}
+	}
+	if opts.Limit == 0 || opts.Limit > webMaxLimit {
+		opts.Limit = webMaxLimit
+	}
+	if err = opts.check(); err != nil {
+		return opts, err
+	}
+	now := time.Now()
+	for name, t := range map[string]*time.Time{
+		"time_first_after":  &opts.FirstAfter,
+		"time_first_before": &opts.FirstBefore,
+		"time_last_after":   &opts.LastAfter,
+		"time_last_before":  &opts.LastBefore,
+	} {
+		*t, err = parseFence(req.FormValue(name), now)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return opts, nil
+}
+
+//pageURL is the path of the request with the same parameters and a
+//different offset. Only the path is kept so the link can't point anywhere
+//else.
+func pageURL(req *http.Request, offset int) string {
+	q := url.Values{}
+	for name, values := range req.URL.Query() {
+		q[name] = values
+	}
+	q.Set("offset", strconv.Itoa(offset))
+	u := url.URL{Path: req.URL.Path, RawQuery: q.Encode()}
+	return u.String()
+}
+
+//pageLinks returns the URLs of the previous and next pages of a search
+//with a limit, or "" for pages that don't exist
+func pageLinks(req *http.Request, opts SearchOptions, more bool) (string, string) {
+	var prev, next string
+	if opts.Limit <= 0 {
+		return prev, next
+	}
+	if opts.Offset > 0 {
+		offset := opts.Offset - opts.Limit
+		if offset < 0 {
+			offset = 0
+		}
+		prev = pageURL(req, offset)
+	}
+	if more {
+		next = pageURL(req, opts.Offset+opts.Limit)
+	}
+	return prev, next
+}
+
+//setPageHeaders links to the other pages of a search the same way github
+//does. X-Truncated is set when there are more results.
+func setPageHeaders(w http.ResponseWriter, req *http.Request, opts SearchOptions, more bool) {
+	prev, next := pageLinks(req, opts, more)
+	var links []string
+	if prev != "" {
+		links = append(links, "<"+prev+`>; rel="prev"`)
+	}
+	if next != "" {
+		links = append(links, "<"+next+`>; rel="next"`)
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	if more {
+		w.Header().Set("X-Truncated", "true")
+	}
 }
 
 func (h *pdnsHandler) handleSearchTuples(w http.ResponseWriter, req *http.Request) {
@@ -26,19 +169,56 @@ func (h *pdnsHandler) handleSearchTuples(w http.ResponseWriter, req *http.Reques
 		http.Error(w, "Missing parameter: q", http.StatusBadRequest)
 		return
 	}
-	var err error
-	var recs tupleResults
-	if searchType == "like" {
-		recs, err = h.s.LikeTuples(query)
+	opts, err := requestSearchOptions(req, apiDefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var search func(string, SearchOptions) (tupleResults, error)
+	if searchType == "cidr" {
+		if !isIPRange(query) {
+			http.Error(w, "Invalid prefix: "+query, http.StatusBadRequest)
+			return
+		}
+		search = h.s.CIDRTuples
+	} else if searchType == "contains" {
+		search = h.s.ContainsTuples
+	} else if searchType == "glob" || (searchType == "like" && isGlob(query)) {
+		search = h.s.GlobTuples
+	} else if searchType == "like" {
+		search = h.s.LikeTuples
 	} else {
-		recs, err = h.s.FindTuples(query)
+		search = h.s.FindTuples
 	}
+	recs, more, err := tuplePage(search, query, opts)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	setPageHeaders(w, req, opts, more)
+	json.NewEncoder(w).Encode(recs)
+}
+func (h *pdnsHandler) handleSearchAnswers(w http.ResponseWriter, req *http.Request) {
+	query := mux.Vars(req)["query"]
+
+	if query == "" {
+		http.Error(w, "Missing parameter: q", http.StatusBadRequest)
+		return
+	}
+	opts, err := requestSearchOptions(req, apiDefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs, more, err := tuplePage(h.s.LikeAnswers, query, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageHeaders(w, req, opts, more)
 	json.NewEncoder(w).Encode(recs)
 }
 func (h *pdnsHandler) handleSearchIndividual(w http.ResponseWriter, req *http.Request) {
@@ -50,77 +230,238 @@ func (h *pdnsHandler) handleSearchIndividual(w http.ResponseWriter, req *http.Re
 		http.Error(w, "Missing parameter: q", http.StatusBadRequest)
 		return
 	}
-	var err error
-	var recs individualResults
-	if searchType == "like" {
-		recs, err = h.s.LikeIndividual(query)
+	opts, err := requestSearchOptions(req, apiDefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var search func(string, SearchOptions) (individualResults, error)
+	if searchType == "contains" {
+		search = h.s.ContainsIndividual
+	} else if searchType == "glob" || (searchType == "like" && isGlob(query)) {
+		search = h.s.GlobIndividual
+	} else if searchType == "like" {
+		search = h.s.LikeIndividual
 	} else {
-		recs, err = h.s.FindIndividual(query)
+		search = h.s.FindIndividual
 	}
+	recs, more, err := individualPage(search, query, opts)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	setPageHeaders(w, req, opts, more)
 	json.NewEncoder(w).Encode(recs)
 }
 
+func (h *pdnsHandler) handleSearchRcodes(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	searchType := vars["searchType"]
+	query := vars["query"]
+
+	if query == "" {
+		http.Error(w, "Missing parameter: q", http.StatusBadRequest)
+		return
+	}
+	opts, err := requestSearchOptions(req, apiDefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	search := h.s.FindRcodes
+	if searchType == "like" {
+		search = h.s.LikeRcodes
+	}
+	recs, more, err := rcodePage(search, query, opts)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageHeaders(w, req, opts, more)
+	json.NewEncoder(w).Encode(recs)
+}
+
+//handlePDNSQuery answers like CIRCL's passive DNS does, in COF with a
+//record per line for every tuple with the query as its name or answer
+func (h *pdnsHandler) handlePDNSQuery(w http.ResponseWriter, req *http.Request) {
+	query := mux.Vars(req)["query"]
+
+	if query == "" {
+		http.Error(w, "Missing parameter: q", http.StatusBadRequest)
+		return
+	}
+	opts, err := requestSearchOptions(req, apiDefaultLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recs, more, err := tuplePage(h.s.FindTuples, query, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setPageHeaders(w, req, opts, more)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	cw := newCOFWriter(w)
+	for _, rec := range recs {
+		err = cw.Write(rec)
+		if err != nil {
+			log.Printf("Error writing COF: %v", err)
+			return
+		}
+	}
+}
+
+//uiPageSize is the limit the UI uses when none is given
+const uiPageSize = 100
+
+//uiRRTypes are the answer types the UI can filter on
+var uiRRTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "PTR", "SOA", "SRV", "TXT"}
+
+//uiTemplate escapes everything it shows, since queries, answers and the
+//search parameters all come from outside
+var uiTemplate = template.Must(template.New("index.html").ParseFS(content, "template/index.html"))
+
 type Results struct {
-	Query      string
-	Exact      bool
+	Query     string
+	Exact     bool
+	Contains  bool
+	Sensor    string
+	BySensor  bool
+	RawPrefix bool
+	//The time fences as they were entered
+	FirstAfter  string
+	FirstBefore string
+	LastAfter   string
+	LastBefore  string
+	Limit       int
+	Sort        string
+	RRTypes     map[string]bool
+	AllRRTypes  []string
+	//Prev and Next link to the other pages of results
+	Prev       string
+	Next       string
 	Individual individualResults
 	Tuples     tupleResults
+	Rcodes     rcodeResults
 	Error      error
 }
 
 func (h *pdnsHandler) handleUI(w http.ResponseWriter, req *http.Request) {
-	var err error
 	var res Results
 	res.Query = req.FormValue("query")
 	res.Exact = req.FormValue("exact") == "on"
-	if res.Query != "" {
+	res.Contains = req.FormValue("contains") == "on"
+	res.FirstAfter = req.FormValue("time_first_after")
+	res.FirstBefore = req.FormValue("time_first_before")
+	res.LastAfter = req.FormValue("time_last_after")
+	res.LastBefore = req.FormValue("time_last_before")
+	opts, err := requestSearchOptions(req, uiPageSize)
+	res.Sensor = opts.Sensor
+	res.BySensor = opts.BySensor
+	res.RawPrefix = opts.RawPrefix
+	res.Limit = opts.Limit
+	res.Sort = opts.Sort
+	res.AllRRTypes = uiRRTypes
+	res.RRTypes = make(map[string]bool)
+	for _, rrtype := range opts.RRTypes {
+		res.RRTypes[strings.ToUpper(rrtype)] = true
+	}
+	//A page has up to limit of each kind of record, there is a next page
+	//if there are more of any of them
+	var more bool
+	addTuples := func(search func(string, SearchOptions) (tupleResults, error)) {
+		recs, m, err := tuplePage(search, res.Query, opts)
+		if err != nil {
+			res.Error = err
+		}
+		res.Tuples, more = recs, more || m
+	}
+	addIndividual := func(search func(string, SearchOptions) (individualResults, error)) {
+		recs, m, err := individualPage(search, res.Query, opts)
+		if err != nil {
+			res.Error = err
+		}
+		res.Individual, more = recs, more || m
+	}
+	addRcodes := func(search func(string, SearchOptions) (rcodeResults, error)) {
+		recs, m, err := rcodePage(search, res.Query, opts)
+		if err != nil {
+			res.Error = err
+		}
+		res.Rcodes, more = recs, more || m
+	}
+	if err != nil {
+		res.Error = err
+	} else if isIPRange(res.Query) {
+		addTuples(h.s.CIDRTuples)
+	} else if res.Contains && res.Query != "" {
+		addIndividual(h.s.ContainsIndividual)
+		addTuples(h.s.ContainsTuples)
+	} else if !res.Exact && isGlob(res.Query) {
+		addIndividual(h.s.GlobIndividual)
+		addTuples(h.s.GlobTuples)
+	} else if res.Query != "" {
 		if res.Exact {
-			res.Individual, err = h.s.FindIndividual(res.Query)
-			if err != nil {
-				res.Error = err
-			}
-			res.Tuples, err = h.s.FindTuples(res.Query)
-			if err != nil {
-				res.Error = err
-			}
+			addIndividual(h.s.FindIndividual)
+			addTuples(h.s.FindTuples)
+			addRcodes(h.s.FindRcodes)
 		} else {
-			res.Individual, err = h.s.LikeIndividual(res.Query)
-			if err != nil {
-				res.Error = err
-			}
-			res.Tuples, err = h.s.LikeTuples(res.Query)
-			if err != nil {
-				res.Error = err
-			}
+			addIndividual(h.s.LikeIndividual)
+			addTuples(h.s.LikeTuples)
+			addRcodes(h.s.LikeRcodes)
 		}
 	}
+	res.Prev, res.Next = pageLinks(req, opts, more)
 
-	var t = template.Must(template.New("index.html").ParseFS(content, "template/index.html"))
-	err = t.Execute(w, res)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	err = uiTemplate.Execute(w, res)
 	if err != nil {
 		log.Printf("Error rendering template: %v", err)
 	}
 }
 
-func startWeb(s Store, bind string) {
-	h := &pdnsHandler{s: s}
+//newRouter returns the routes of the HTTP API and UI, with the DNSDB API
+//v2 compatible ones if dnsdb is set
+func newRouter(s Store, cfg webConfig) *mux.Router {
+	h := &pdnsHandler{s: s, pushToken: cfg.pushToken, pushMaxBytes: cfg.pushMaxBytes}
+	if h.pushMaxBytes <= 0 {
+		h.pushMaxBytes = defaultPushMaxBytes
+	}
 	r := mux.NewRouter()
 
+	//A prefix has a / in it
+	r.HandleFunc("/dns/{searchType:cidr}/tuples/{query:.+}", h.handleSearchTuples)
 	r.HandleFunc("/dns/{searchType}/tuples/{query}", h.handleSearchTuples)
 	r.HandleFunc("/dns/{searchType}/individual/{query}", h.handleSearchIndividual)
+	r.HandleFunc("/dns/like/answers/{query}", h.handleSearchAnswers)
+	r.HandleFunc("/dns/{searchType}/rcodes/{query}", h.handleSearchRcodes)
+	r.HandleFunc("/pdns/query/{query}", h.handlePDNSQuery)
 
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/ui/", http.StatusSeeOther)
 	})
 	r.HandleFunc("/ui/", h.handleUI)
 
-	http.Handle("/", r)
+	if cfg.dnsdb {
+		h.mountDNSDB(r)
+	}
+	if cfg.pushToken != "" {
+		r.HandleFunc(pushPath, h.handlePush).Methods("POST")
+	}
+	return r
+}
+
+func startWeb(s Store, bind string, cfg webConfig) {
+	http.Handle("/", newRouter(s, cfg))
 
 	log.Printf("Listening on %q\n", bind)
 	log.Fatal(http.ListenAndServe(bind, nil))
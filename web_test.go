@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUIEscaping(t *testing.T) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Clear()
+	store.Init()
+	//Anything can be in a query name in a log
+	cof := `{"rrname":"<script>alert(1)</script>.example.com","rrtype":"A","rdata":"10.1.2.3","time_first":1617580800,"time_last":1617580800,"count":1}
+{"rrname":"www.example.com","rrtype":"A","rdata":"10.1.2.4","time_first":1617580800,"time_last":1617580800,"count":1}
+`
+	err = indexSources(store, "", []logSource{{reader: strings.NewReader(cof), format: "cof"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(store, webConfig{}))
+	defer srv.Close()
+
+	q := url.Values{
+		"query":            {"10.1.2.0/24"},
+		"sensor":           {`"><script>alert(2)</script>`},
+		"time_first_after": {`"><b>`},
+		"limit":            {"1"},
+	}
+	resp, err := http.Get(srv.URL + "/ui/?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(body)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.NotContains(t, page, "<script>")
+	assert.NotContains(t, page, "<b>")
+	assert.Contains(t, page, "&lt;script&gt;alert(2)&lt;/script&gt;")
+}
+
+func TestPageLinks(t *testing.T) {
+	req := httptest.NewRequest("GET", `/ui/?query=example.com&sensor="><x>&limit=10&offset=20`, nil)
+	prev, next := pageLinks(req, SearchOptions{Limit: 10, Offset: 20}, true)
+	assert.Equal(t, "/ui/?limit=10&offset=10&query=example.com&sensor=%22%3E%3Cx%3E", prev)
+	assert.Equal(t, "/ui/?limit=10&offset=30&query=example.com&sensor=%22%3E%3Cx%3E", next)
+
+	prev, next = pageLinks(req, SearchOptions{Limit: 10}, false)
+	assert.Equal(t, "", prev)
+	assert.Equal(t, "", next)
+}
+
+func TestAPIOriginal(t *testing.T) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Clear()
+	store.Init()
+	cof := `{"rrname":"WWW.Example.COM.","rrtype":"A","rdata":"10.1.2.3","time_first":1617580800,"time_last":1617580800,"count":1}
+`
+	err = indexSources(store, "", []logSource{{reader: strings.NewReader(cof), format: "cof"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(store, webConfig{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/dns/find/tuples/www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tuples tupleResults
+	err = json.NewDecoder(resp.Body).Decode(&tuples)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, tuples, 1) {
+		assert.Equal(t, "WWW.Example.COM.", tuples[0].Original)
+	}
+
+	resp, err = http.Get(srv.URL + "/dns/find/individual/www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var individual individualResults
+	err = json.NewDecoder(resp.Body).Decode(&individual)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, individual, 1) {
+		assert.Equal(t, "WWW.Example.COM.", individual[0].Original)
+	}
+}
+
+func TestAPIPaging(t *testing.T) {
+	store, err := NewStore("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Clear()
+	store.Init()
+	cof := `{"rrname":"a.example.com","rrtype":"A","rdata":"10.1.2.3","time_first":1617580800,"time_last":1617580800,"count":1}
+{"rrname":"b.example.com","rrtype":"A","rdata":"10.1.2.3","time_first":1617580800,"time_last":1617580800,"count":1}
+{"rrname":"c.example.com","rrtype":"A","rdata":"10.1.2.3","time_first":1617580800,"time_last":1617580800,"count":1}
+`
+	err = indexSources(store, "", []logSource{{reader: strings.NewReader(cof), format: "cof"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newRouter(store, webConfig{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/dns/like/tuples/example.com?limit=2&sort=-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tuples tupleResults
+	err = json.NewDecoder(resp.Body).Decode(&tuples)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, tuples, 2) {
+		assert.Equal(t, "c.example.com", tuples[0].Query)
+	}
+	assert.Equal(t, "true", resp.Header.Get("X-Truncated"))
+	assert.Equal(t, `</dns/like/tuples/example.com?limit=2&offset=2&sort=-name>; rel="next"`, resp.Header.Get("Link"))
+
+	for _, params := range []string{"limit=-1", "limit=x", "offset=-1", "sort=clients"} {
+		resp, err = http.Get(srv.URL + "/dns/like/tuples/example.com?" + params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, params)
+	}
+
+	//Pages always have a limit, so an offset alone pages through the
+	//default one
+	opts, err := requestSearchOptions(httptest.NewRequest("GET", "/?offset=10", nil), apiDefaultLimit)
+	if assert.NoError(t, err) {
+		assert.Equal(t, apiDefaultLimit, opts.Limit)
+	}
+	opts, err = requestSearchOptions(httptest.NewRequest("GET", "/?limit=0", nil), apiDefaultLimit)
+	if assert.NoError(t, err) {
+		assert.Equal(t, webMaxLimit, opts.Limit)
+	}
+}